@@ -1,12 +1,24 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 // Environment variable names
 const (
 	envPort           = "PORT"
 	envMaxConnections = "MAX_CONNECTIONS"
 	envRedisAddr      = "REDIS_ADDR"
+	envHistoryBackend = "HISTORY_BACKEND"
+	envHistoryDir     = "HISTORY_DIR"
+	envHistoryMax     = "HISTORY_MAX_ENTRIES"
+	envSecret         = "SECRET"
+	envTicketTTL      = "TICKET_TTL"
+	envSystemSender   = "SYSTEM_SENDER"
+	envUnhealthyAfter = "UNHEALTHY_AFTER"
+	envEvictAfter     = "EVICT_AFTER"
 )
 
 // Default config
@@ -14,13 +26,29 @@ var defaults = map[string]interface{}{
 	(envPort):           "8081",
 	(envMaxConnections): 255,
 	(envRedisAddr):      ":6379",
+	(envHistoryBackend): "",
+	(envHistoryDir):     "history",
+	(envHistoryMax):     10000,
+	(envSecret):         "secret",
+	(envTicketTTL):      "30s",
+	(envSystemSender):   "system",
+	(envUnhealthyAfter): 3,
+	(envEvictAfter):     6,
 }
 
 // Config implementation
 type Config struct {
-	Port           string // Node port
-	MaxConnections uint64 // Max connections allowed per minion
-	RedisAddr      string // Redis connection string
+	Port           string        // Node port
+	MaxConnections uint64        // Max connections allowed per minion
+	RedisAddr      string        // Redis connection string
+	HistoryBackend string        // Conversation history backend (empty disables history, file is for a single minion only)
+	HistoryDir     string        // Directory for the file history backend, only holds history written by a minion using the same directory
+	HistoryMax     int           // Max history entries kept per conversation
+	Secret         []byte        // Secret shared with minions to verify access tokens and sign tickets
+	TicketTTL      time.Duration // Time a connection ticket is valid for
+	SystemSender   string        // Sender of messages sent through the master
+	UnhealthyAfter int           // Failed health probes in a row after which a minion is marked unhealthy
+	EvictAfter     int           // Failed health probes in a row after which a minion is deregistered (zero never deregisters)
 }
 
 // New creates a new node config.
@@ -37,5 +65,13 @@ func New() *Config {
 		Port:           v.GetString(envPort),
 		MaxConnections: v.GetUint64(envMaxConnections),
 		RedisAddr:      v.GetString(envRedisAddr),
+		HistoryBackend: v.GetString(envHistoryBackend),
+		HistoryDir:     v.GetString(envHistoryDir),
+		HistoryMax:     v.GetInt(envHistoryMax),
+		Secret:         []byte(v.GetString(envSecret)),
+		TicketTTL:      v.GetDuration(envTicketTTL),
+		SystemSender:   v.GetString(envSystemSender),
+		UnhealthyAfter: v.GetInt(envUnhealthyAfter),
+		EvictAfter:     v.GetInt(envEvictAfter),
 	}
 }
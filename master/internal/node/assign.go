@@ -0,0 +1,133 @@
+package node
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// ErrNoMinionAvailable is returned when no minion can accept a new client.
+var ErrNoMinionAvailable = errors.New("no minion is available")
+
+// assignment is a minion assigned to a client, with a ticket to connect to it
+type assignment struct {
+	Minion  string `json:"minion"`  // Minion ID
+	Address string `json:"address"` // Minion address (ip:port)
+	Ticket  string `json:"ticket"`  // Signed connection ticket, only valid on the minion
+	Expires int64  `json:"expires"` // Ticket expiration time (unix seconds)
+}
+
+// assign selects the least loaded minion for a client. Minions in the given region
+// are preferred when region is not empty. When sticky is true, a minion already
+// hosting a session of the client is preferred among the minions of the region.
+func (n *node) assign(user string, region string, sticky bool) (*minion, error) {
+	minions, err := n.getMinions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]minion, 0, len(minions))
+
+	for _, m := range minions {
+		// Minions that do not report their limit get the configured one
+		if m.Capacity == 0 {
+			m.Capacity = n.cfg.MaxConnections
+		}
+
+		if accepting(m) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	// Other regions are only used when none of the region's minions accepts clients
+	if region != "" {
+		if local := inRegion(candidates, region); len(local) > 0 {
+			candidates = local
+		}
+	}
+
+	if sticky {
+		hosts, err := n.getUserMinions(user)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if m := leastLoaded(candidates, func(m minion) bool { _, ok := hosts[m.ID]; return ok }); m != nil {
+			return m, nil
+		}
+	}
+
+	if m := leastLoaded(candidates, func(minion) bool { return true }); m != nil {
+		return m, nil
+	}
+
+	return nil, ErrNoMinionAvailable
+}
+
+// accepting checks if a minion accepts new clients.
+func accepting(m minion) bool {
+	return !m.Draining && !m.Unhealthy && (m.Capacity == 0 || m.Connections < m.Capacity)
+}
+
+// inRegion filters minions by region tag.
+func inRegion(minions []minion, region string) []minion {
+	result := make([]minion, 0, len(minions))
+
+	for _, m := range minions {
+		if m.Region == region {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
+
+// getUserMinions retrieves the ids of minions hosting a session of a client.
+func (n *node) getUserMinions(id string) (map[string]struct{}, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HVALS", clientPrefix+id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]struct{}, len(values))
+
+	for _, id := range values {
+		ids[id] = struct{}{}
+	}
+
+	return ids, nil
+}
+
+// leastLoaded finds the minion matching a filter with the lowest load relative to
+// its capacity. Returns nil if no minion matches.
+func leastLoaded(minions []minion, match func(minion) bool) *minion {
+	var best *minion
+
+	for i := range minions {
+		m := &minions[i]
+
+		if !match(*m) {
+			continue
+		}
+
+		if best == nil || load(m) < load(best) {
+			best = m
+		}
+	}
+
+	return best
+}
+
+// load gets the load of a minion, as a fraction of its capacity if limited.
+func load(m *minion) float64 {
+	if m.Capacity == 0 {
+		return float64(m.Connections)
+	}
+
+	return float64(m.Connections) / float64(m.Capacity)
+}
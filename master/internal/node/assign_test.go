@@ -0,0 +1,91 @@
+package node
+
+import "testing"
+
+func TestLeastLoaded(t *testing.T) {
+	all := func(minion) bool { return true }
+
+	tests := []struct {
+		name    string
+		minions []minion
+		match   func(minion) bool
+		want    string
+	}{
+		{
+			name:    "no minions",
+			minions: nil,
+			match:   all,
+			want:    "",
+		},
+		{
+			name:    "fewest connections",
+			minions: []minion{{ID: "a", Connections: 5}, {ID: "b", Connections: 2}, {ID: "c", Connections: 9}},
+			match:   all,
+			want:    "b",
+		},
+		{
+			name:    "relative to capacity",
+			minions: []minion{{ID: "a", Connections: 50, Capacity: 100}, {ID: "b", Connections: 200, Capacity: 1000}},
+			match:   all,
+			want:    "b",
+		},
+		{
+			name:    "first of equal loads",
+			minions: []minion{{ID: "a", Connections: 10, Capacity: 100}, {ID: "b", Connections: 1, Capacity: 10}},
+			match:   all,
+			want:    "a",
+		},
+		{
+			name:    "matching only",
+			minions: []minion{{ID: "a", Connections: 1}, {ID: "b", Connections: 5}, {ID: "c", Connections: 3}},
+			match:   func(m minion) bool { return m.ID != "a" },
+			want:    "c",
+		},
+		{
+			name:    "none matching",
+			minions: []minion{{ID: "a"}, {ID: "b"}},
+			match:   func(minion) bool { return false },
+			want:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := leastLoaded(tt.minions, tt.match)
+
+			if tt.want == "" {
+				if m != nil {
+					t.Errorf("leastLoaded = %s, want none", m.ID)
+				}
+
+				return
+			}
+
+			if m == nil || m.ID != tt.want {
+				t.Errorf("leastLoaded = %+v, want %s", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccepting(t *testing.T) {
+	tests := []struct {
+		name   string
+		minion minion
+		want   bool
+	}{
+		{name: "below capacity", minion: minion{Connections: 9, Capacity: 10}, want: true},
+		{name: "at capacity", minion: minion{Connections: 10, Capacity: 10}, want: false},
+		{name: "unlimited", minion: minion{Connections: 1000}, want: true},
+		{name: "draining", minion: minion{Draining: true}, want: false},
+		{name: "unhealthy", minion: minion{Unhealthy: true}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := accepting(tt.minion); got != tt.want {
+				t.Errorf("accepting = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
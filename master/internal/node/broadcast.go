@@ -0,0 +1,130 @@
+package node
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+)
+
+// broadcastRequest is a broadcast message with its filters. Only minions that
+// may host a matching session are sent the broadcast.
+type broadcastRequest struct {
+	control.BroadcastData
+	Minions []string `json:"minions,omitempty"` // Only these minions
+}
+
+// broadcastResult is the result of a broadcast
+type broadcastResult struct {
+	Delivered int             `json:"delivered"` // Sessions the message was delivered to
+	Minions   []commandResult `json:"minions"`   // Result of each targeted minion
+}
+
+// broadcast broadcasts a message to every session matching the request filters,
+// returning delivery counts per minion.
+func (n *node) broadcast(req *broadcastRequest) (*broadcastResult, error) {
+	ids, err := n.getMinionIDs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Minions) > 0 {
+		ids = intersect(ids, toSet(req.Minions))
+	}
+
+	// Minions hosting a session of the users
+	if len(req.Users) > 0 {
+		hosts, err := n.locateMinions("HVALS", clientPrefix, req.Users)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = intersect(ids, hosts)
+	}
+
+	// Minions with a member of the rooms
+	if len(req.Rooms) > 0 {
+		hosts, err := n.locateMinions("HKEYS", roomPrefix, req.Rooms)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = intersect(ids, hosts)
+	}
+
+	res := &broadcastResult{
+		Minions: n.commandMulti(ids, control.Broadcast, &req.BroadcastData),
+	}
+
+	for _, r := range res.Minions {
+		if count, ok := r.Result.(*control.CountData); ok {
+			res.Delivered += count.Count
+		}
+	}
+
+	return res, nil
+}
+
+// locateMinions retrieves the ids of minions found in the hashes of many keys,
+// where cmd is HKEYS or HVALS depending on where the hashes store minion ids.
+func (n *node) locateMinions(cmd string, prefix string, ids []string) (map[string]struct{}, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if err := conn.Send(cmd, prefix+id); err != nil {
+			return nil, err
+		}
+	}
+
+	values, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	minions := make(map[string]struct{})
+
+	for _, val := range values {
+		hosts, err := redis.Strings(val, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range hosts {
+			minions[id] = struct{}{}
+		}
+	}
+
+	return minions, nil
+}
+
+// toSet creates a set from a list of ids.
+func toSet(ids []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+
+	return set
+}
+
+// intersect gets the ids found in both sets.
+func intersect(a map[string]struct{}, b map[string]struct{}) map[string]struct{} {
+	set := make(map[string]struct{})
+
+	for id := range a {
+		if _, ok := b[id]; ok {
+			set[id] = struct{}{}
+		}
+	}
+
+	return set
+}
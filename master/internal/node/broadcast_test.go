@@ -0,0 +1,51 @@
+package node
+
+import "testing"
+
+// set creates a set of ids.
+func set(ids ...string) map[string]struct{} {
+	s := make(map[string]struct{}, len(ids))
+
+	for _, id := range ids {
+		s[id] = struct{}{}
+	}
+
+	return s
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a    map[string]struct{}
+		b    map[string]struct{}
+		want map[string]struct{}
+	}{
+		{name: "both empty", a: set(), b: set(), want: set()},
+		{name: "nil sets", a: nil, b: nil, want: set()},
+		{name: "one empty", a: set("a", "b"), b: set(), want: set()},
+		{name: "disjoint", a: set("a", "b"), b: set("c", "d"), want: set()},
+		{name: "overlapping", a: set("a", "b", "c"), b: set("b", "c", "d"), want: set("b", "c")},
+		{name: "subset", a: set("a"), b: set("a", "b"), want: set("a")},
+		{name: "equal", a: set("a", "b"), b: set("a", "b"), want: set("a", "b")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := intersect(tt.a, tt.b)
+
+			if got == nil {
+				t.Fatal("intersect returned a nil set")
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("intersect = %v, want %v", got, tt.want)
+			}
+
+			for id := range tt.want {
+				if _, ok := got[id]; !ok {
+					t.Errorf("intersect = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+	"github.com/pkg/errors"
+)
+
+const (
+	controlTimeout = 5 // Time (in seconds) to wait for a minion to respond to a control request
+)
+
+// ErrControlTimeout is returned when a minion does not respond to a control request in time.
+var ErrControlTimeout = errors.New("minion did not respond to the control request in time")
+
+// commandResult is the result of a control command run on a minion
+type commandResult struct {
+	Minion string      `json:"minion"`           // Minion ID
+	Error  string      `json:"error,omitempty"`  // Error, empty if the command succeeded
+	Result interface{} `json:"result,omitempty"` // Command result
+}
+
+// command runs a control command on a minion and waits for its result.
+func (n *node) command(id string, cmd control.Command, payload interface{}) (interface{}, error) {
+	req, err := control.NewRequest(cmd, payload, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := req.GetBytes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.sendMessage(id, data); err != nil {
+		return nil, err
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.ByteSlices(conn.Do("BLPOP", req.ReplyTo, controlTimeout))
+
+	if err == redis.ErrNil {
+		return nil, ErrControlTimeout
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := control.ResponseFromBytes(reply[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := cmd.Result()
+
+	if err := res.Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// commandAll runs a control command on every active minion and waits for their results.
+func (n *node) commandAll(cmd control.Command, payload interface{}) ([]commandResult, error) {
+	ids, err := n.getMinionIDs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return n.commandMulti(ids, cmd, payload), nil
+}
+
+// commandMulti runs a control command on many minions at once and waits for their results.
+func (n *node) commandMulti(ids map[string]struct{}, cmd control.Command, payload interface{}) []commandResult {
+	payloads := make(map[string]interface{}, len(ids))
+
+	for id := range ids {
+		payloads[id] = payload
+	}
+
+	return n.commandEach(cmd, payloads)
+}
+
+// commandEach runs a control command on many minions at once, each with its own payload,
+// and waits for their results. Payloads are mapped by minion id.
+func (n *node) commandEach(cmd control.Command, payloads map[string]interface{}) []commandResult {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	results := make([]commandResult, 0, len(payloads))
+
+	for id, payload := range payloads {
+		wg.Add(1)
+
+		go func(id string, payload interface{}) {
+			defer wg.Done()
+
+			r := commandResult{Minion: id}
+
+			if result, err := n.command(id, cmd, payload); err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Result = result
+			}
+
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}(id, payload)
+	}
+
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,255 @@
+package node
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	fencingKey    = "master_fencing" // Key of the fencing token counter, incremented on every election
+	leaderChannel = "leader"         // Channel leadership change events are published on
+	eventElected  = "elected"        // Event published when a node acquires the master lock
+	eventLost     = "lost"           // Event published when a node finds it lost the master lock
+	eventResigned = "resigned"       // Event published when a node releases the master lock
+	lockSeparator = ":"              // Separates the fencing token and node id in the master lock value
+)
+
+// acquireScript acquires the master lock if it is free, storing the next fencing
+// token and the node id in the lock. Returns the fencing token, or nil if the
+// lock is held by another node.
+var acquireScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return false
+end
+local token = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], token .. ":" .. ARGV[1], "EX", ARGV[2])
+return token
+`)
+
+// refreshScript extends the master lock expiration only if the lock still holds
+// the given value. Returns 1 if the lock was refreshed.
+var refreshScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the master lock only if it still holds the given value.
+// Returns 1 if the lock was released.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// leader is the holder of the master lock
+type leader struct {
+	Node    string `json:"node"`    // Node ID of the master, empty if there is no master
+	Fencing int64  `json:"fencing"` // Fencing token of the master
+	Self    bool   `json:"self"`    // The master is this node
+}
+
+// leaderEvent is a leadership change event
+type leaderEvent struct {
+	Event   string `json:"event"`   // Event type
+	Node    string `json:"node"`    // Node ID
+	Fencing int64  `json:"fencing"` // Fencing token
+}
+
+// upgrade attempts to upgrade node to a master node by acquiring the master lock.
+// The lock is acquired if the master key does not exist, in which case it is set
+// to a new fencing token and the node id.
+func (n *node) upgrade() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.master {
+		return false
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	token, err := redis.Int64(acquireScript.Do(conn, masterKey, fencingKey, n.id, masterKeyExpires))
+
+	if err == redis.ErrNil {
+		return false
+	}
+
+	if err != nil {
+		log.Printf("[error] error acquiring master lock: %v", err)
+		return false
+	}
+
+	log.Printf("[info] acquired master lock (fencing token %d), upgrading node to master...", token)
+
+	n.master = true
+	n.fencing = token
+	n.publish(eventElected, token)
+	n.startJobs(token)
+
+	return false
+}
+
+// isMaster checks if the node is the master node.
+func (n *node) isMaster() bool {
+	n.RLock()
+	defer n.RUnlock()
+	return n.master
+}
+
+// fencingToken gets the fencing token of the node, or zero if the node is not the master.
+// Writes made on behalf of the master should carry the token so that stale masters can
+// be detected.
+func (n *node) fencingToken() int64 {
+	n.RLock()
+	defer n.RUnlock()
+
+	if !n.master {
+		return 0
+	}
+
+	return n.fencing
+}
+
+// leads checks if the node is still the master node of the term identified by a fencing token.
+// Jobs check it to skip work on behalf of a stale master. The check is local, so writes are
+// also fenced in redis, see doFenced.
+func (n *node) leads(token int64) bool {
+	return n.fencingToken() == token
+}
+
+// maintain maintains control of master lock by extending the master key's expiration time,
+// as long as the lock still belongs to this node. If the node goes down, the master key will
+// eventually expire and become available to other nodes to acquire.
+func (n *node) maintain() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.master {
+		return false
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Bool(refreshScript.Do(conn, masterKey, n.lockValue(), masterKeyExpires))
+
+	if err != nil {
+		log.Printf("[error] error extending master key expiration: %v", err)
+		n.demote()
+		return false
+	}
+
+	if !ok {
+		log.Printf("[warn] master lock is no longer held by this node")
+		n.demote()
+	}
+
+	return false
+}
+
+// resign releases the master lock if it is held by this node.
+func (n *node) resign() {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.master {
+		return
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Bool(releaseScript.Do(conn, masterKey, n.lockValue()))
+
+	if err != nil {
+		log.Printf("[error] error releasing master lock: %v", err)
+	}
+
+	if ok {
+		log.Print("[info] released master lock")
+		n.publish(eventResigned, n.fencing)
+	}
+
+	n.master = false
+	n.stopJobs()
+}
+
+// demote downgrades the node after it lost the master lock. Must be called with the node locked.
+func (n *node) demote() {
+	n.master = false
+	n.publish(eventLost, n.fencing)
+	n.stopJobs()
+}
+
+// lockValue gets the master lock value of the node. Must be called with the node locked.
+func (n *node) lockValue() string {
+	return n.lockValueFor(n.fencing)
+}
+
+// lockValueFor gets the master lock value of the node for the term of a fencing token.
+func (n *node) lockValueFor(token int64) string {
+	return strconv.FormatInt(token, 10) + lockSeparator + n.id
+}
+
+// publish publishes a leadership change event of this node.
+func (n *node) publish(event string, token int64) {
+	leaderChanges.WithLabelValues(event).Inc()
+
+	data, err := json.Marshal(&leaderEvent{
+		Event:   event,
+		Node:    n.id,
+		Fencing: token,
+	})
+
+	if err != nil {
+		log.Printf("[error] error encoding leader event: %v", err)
+		return
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", leaderChannel, data); err != nil {
+		log.Printf("[error] error publishing leader event: %v", err)
+	}
+}
+
+// getLeader retrieves the current holder of the master lock.
+func (n *node) getLeader() (*leader, error) {
+	value, err := redis.String(n.redis.Get(masterKey))
+
+	if err == redis.ErrNil {
+		return &leader{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(value, lockSeparator, 2)
+
+	// Locks set by older masters only hold a placeholder value
+	if len(parts) != 2 {
+		return &leader{}, nil
+	}
+
+	token, err := strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &leader{
+		Node:    parts[1],
+		Fencing: token,
+		Self:    parts[1] == n.id,
+	}, nil
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	notMasterReply = "NOTMASTER" // Error reply of fenced scripts run by a node that lost the master lock
+)
+
+// ErrNotMaster is returned when a write made on behalf of a master is refused
+// because the node no longer holds the master lock of its term.
+var ErrNotMaster = errors.New("node no longer holds the master lock")
+
+// fenceCheck aborts a script unless the master lock (KEYS[1]) holds the lock value
+// of the writer (ARGV[1]). Checking the lock within the script makes the check and
+// the write atomic, so that a master paused past its lock expiration cannot write.
+const fenceCheck = `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return redis.error_reply("` + notMasterReply + `")
+end
+`
+
+// newFencedScript creates a script that only runs while the writer holds the master
+// lock. The script body finds its own keys and arguments from KEYS[2] and ARGV[2].
+func newFencedScript(keyCount int, body string) *redis.Script {
+	return redis.NewScript(keyCount+1, fenceCheck+body)
+}
+
+// fencedDelScript deletes a key.
+var fencedDelScript = newFencedScript(1, `
+return redis.call("DEL", KEYS[2])
+`)
+
+// fencedHdelScript deletes a field of a hash.
+var fencedHdelScript = newFencedScript(1, `
+return redis.call("HDEL", KEYS[2], ARGV[2])
+`)
+
+// fencedSetScript sets a key with an expiration (in seconds).
+var fencedSetScript = newFencedScript(1, `
+return redis.call("SET", KEYS[2], ARGV[2], "EX", ARGV[3])
+`)
+
+// fencedPopScript removes and returns up to count messages from the head of a
+// queue, or every message if count is zero.
+var fencedPopScript = newFencedScript(1, `
+local count = tonumber(ARGV[2])
+local messages = redis.call("LRANGE", KEYS[2], 0, count - 1)
+if count > 0 then
+	redis.call("LTRIM", KEYS[2], count, -1)
+else
+	redis.call("DEL", KEYS[2])
+end
+return messages
+`)
+
+// doFenced runs a fenced script on behalf of the master term identified by a fencing
+// token. Returns ErrNotMaster if the node no longer holds the master lock of the term.
+func (n *node) doFenced(conn redis.Conn, script *redis.Script, token int64, keys []interface{}, args ...interface{}) (interface{}, error) {
+	params := make([]interface{}, 0, len(keys)+len(args)+2)
+	params = append(params, masterKey)
+	params = append(params, keys...)
+	params = append(params, n.lockValueFor(token))
+	params = append(params, args...)
+
+	reply, err := script.Do(conn, params...)
+
+	if err, ok := err.(redis.Error); ok && err.Error() == notMasterReply {
+		return nil, ErrNotMaster
+	}
+
+	return reply, err
+}
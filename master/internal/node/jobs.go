@@ -0,0 +1,75 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/pkg/task"
+)
+
+// job is a periodic cluster maintenance duty that only runs on the master node
+type job struct {
+	name   string                  // Job name
+	period time.Duration           // Run the job with this period
+	run    func(token int64) error // Job function, given the fencing token of the master
+}
+
+// initJobs initializes the leader-only jobs of the node.
+func (n *node) initJobs() {
+	n.jobs = []job{
+		{name: "reclaim", period: reclaimPeriod, run: n.reclaim},
+		{name: "probe", period: probePeriod, run: n.probe},
+		{name: "stats", period: statsPeriod, run: n.aggregateStats},
+	}
+}
+
+// startJobs starts the leader-only jobs for a new term of the node as master,
+// identified by its fencing token. Must be called with the node locked.
+func (n *node) startJobs(token int64) {
+	n.termc = make(chan struct{})
+
+	for _, j := range n.jobs {
+		task.New(n.runJob(j, token), j.period, &n.jobsWg, n.termc)
+	}
+
+	log.Printf("[info] started %d master jobs", len(n.jobs))
+}
+
+// stopJobs stops the leader-only jobs at the end of a term of the node as master.
+// Jobs finish their current run in the background. Must be called with the node locked.
+func (n *node) stopJobs() {
+	if n.termc == nil {
+		return
+	}
+
+	close(n.termc)
+	n.termc = nil
+
+	log.Print("[info] stopped master jobs")
+}
+
+// runJob wraps a job into a task that runs it as long as the node holds the
+// master lock it was started under.
+func (n *node) runJob(j job, token int64) func() bool {
+	return func() bool {
+		// Leadership was lost since the job was started
+		if !n.leads(token) {
+			return true
+		}
+
+		start := time.Now()
+		err := j.run(token)
+		observeJob(j.name, start, err)
+
+		if err == ErrNotMaster {
+			log.Printf("[warn] %s job stopped, node lost the master lock", j.name)
+			return false
+		}
+
+		if err != nil {
+			log.Printf("[error] error running %s job: %v", j.name, err)
+		}
+
+		return false
+	}
+}
@@ -0,0 +1,76 @@
+package node
+
+import (
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsSubsystem = "master" // Subsystem of master metrics
+)
+
+var (
+	leaderChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "leader_changes_total",
+		Help:      "Total number of leadership changes of the node, by event.",
+	}, []string{"event"})
+
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "job_runs_total",
+		Help:      "Total number of master job runs, by job and result.",
+	}, []string{"job", "result"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "job_duration_seconds",
+		Help:      "Time taken by master job runs, by job.",
+	}, []string{"job"})
+)
+
+func init() {
+	prometheus.MustRegister(leaderChanges, jobRuns, jobDuration)
+}
+
+// observeJob records a run of a job started at a given time.
+func observeJob(name string, start time.Time, err error) {
+	result := "ok"
+
+	if err != nil {
+		result = "error"
+	}
+
+	jobRuns.WithLabelValues(name, result).Inc()
+	jobDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// registerMetrics registers the metrics bound to the node.
+func (n *node) registerMetrics() {
+	prometheus.MustRegister(
+		metrics.NewPoolCollector(metricsSubsystem, n.redis.Pool),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "leader",
+			Help:      "Whether the node holds the master lock (1) or not (0).",
+		}, func() float64 {
+			if n.isMaster() {
+				return 1
+			}
+
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fencing_token",
+			Help:      "Fencing token of the node's current term as master, or 0 if it is not the master.",
+		}, func() float64 { return float64(n.fencingToken()) }),
+	)
+}
@@ -18,10 +18,16 @@ var ErrMinionNotFound = errors.New("could not find the requested minion")
 
 // minion implementation
 type minion struct {
-	ID          string `redis:"id" json:"id"`                   // Minion ID
-	IP          string `redis:"ip" json:"ip"`                   // Minion external IP
-	Port        string `redis:"port" json:"port"`               // Minion port
-	Connections uint64 `redis:"connections" json:"connections"` // Minion connections count
+	ID          string `redis:"id" json:"id"`                     // Minion ID
+	IP          string `redis:"ip" json:"ip"`                     // Minion external IP
+	Port        string `redis:"port" json:"port"`                 // Minion port
+	AdminPort   string `redis:"admin_port" json:"admin_port"`     // Minion admin port
+	Connections uint64 `redis:"connections" json:"connections"`   // Minion connections count
+	Capacity    uint64 `redis:"capacity" json:"capacity"`         // Minion connection limit (zero is unlimited)
+	Region      string `redis:"region" json:"region,omitempty"`   // Minion region tag
+	DrainWindow int64  `redis:"drain_window" json:"drain_window"` // Minion drain window (milliseconds)
+	Draining    bool   `redis:"draining" json:"draining"`         // Minion is draining
+	Unhealthy   bool   `redis:"unhealthy" json:"unhealthy"`       // Minion failed its recent health probes
 }
 
 // getMinionKeys retrieves all keys for active minions in redis.
@@ -29,7 +35,25 @@ func (n *node) getMinionKeys() ([]string, error) {
 	return n.redis.GetKeys(minionPrefix + "*")
 }
 
-// getMinions retrieves all active minions from redis.
+// getMinionIDs retrieves the ids of all active minions in redis.
+func (n *node) getMinionIDs() (map[string]struct{}, error) {
+	keys, err := n.getMinionKeys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]struct{}, len(keys))
+
+	for _, key := range keys {
+		ids[strings.TrimPrefix(key, minionPrefix)] = struct{}{}
+	}
+
+	return ids, nil
+}
+
+// getMinions retrieves all active minions from redis. Minions whose key expired
+// since the keys were listed are skipped.
 func (n *node) getMinions() (result []minion, err error) {
 	conn := n.redis.Pool.Get()
 	defer conn.Close()
@@ -58,14 +82,16 @@ func (n *node) getMinions() (result []minion, err error) {
 		return result, err
 	}
 
-	for _, val := range values {
-		var m minion
+	for i, val := range values {
+		m := minion{ID: strings.TrimPrefix(keys[i], minionPrefix)}
 
-		if len(val.([]interface{})) == 0 {
-			return result, ErrMinionNotFound
+		fields, ok := val.([]interface{})
+
+		if !ok || len(fields) == 0 {
+			continue
 		}
 
-		if err := redis.ScanStruct(val.([]interface{}), &m); err != nil {
+		if err := redis.ScanStruct(fields, &m); err != nil {
 			return result, err
 		}
 
@@ -87,6 +113,7 @@ func (n *node) getMinion(id string) (result minion, err error) {
 		return result, ErrMinionNotFound
 	}
 
+	result.ID = id
 	err = redis.ScanStruct(values, &result)
 
 	return result, err
@@ -107,31 +134,3 @@ func (n *node) sendMessage(id string, data []byte) error {
 
 	return n.redis.Rpush(messagePrefix+id, data)
 }
-
-// broadcastMessage broadcasts a message to all active minions.
-func (n *node) broadcastMessage(data []byte) (err error) {
-	conn := n.redis.Pool.Get()
-	defer conn.Close()
-
-	var keys []string
-
-	keys, err = n.getMinionKeys()
-
-	if err = conn.Send("MULTI"); err != nil {
-		return err
-	}
-
-	for _, key := range keys {
-		id := strings.Split(key, ":")[1]
-
-		if err = conn.Send("RPUSH", messagePrefix+id, data); err != nil {
-			return err
-		}
-	}
-
-	if _, err = conn.Do("EXEC"); err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -10,15 +10,24 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/makeshiftsoftware/vsnet/master/internal/config"
 	"github.com/makeshiftsoftware/vsnet/pkg/grace"
+	"github.com/makeshiftsoftware/vsnet/pkg/history"
+	"github.com/makeshiftsoftware/vsnet/pkg/metrics"
 	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
 	"github.com/makeshiftsoftware/vsnet/pkg/task"
+	uuid "github.com/satori/go.uuid"
 )
 
 const (
-	upgradePeriod    = 5 * time.Second // Attempt to upgrade node with this period
-	maintainPeriod   = 5 * time.Second // Maintain control of master lock with this period
-	masterKey        = "master"        // Key to use as master lock for node upgrading
-	masterKeyExpires = 10              // Time (in seconds) to expire master lock key (should be longer than refreshPeriod)
+	upgradePeriod    = 5 * time.Second  // Attempt to upgrade node with this period
+	maintainPeriod   = 5 * time.Second  // Maintain control of master lock with this period
+	reclaimPeriod    = 30 * time.Second // Reclaim presence and queues of expired minions with this period
+	probePeriod      = 10 * time.Second // Probe minion health with this period
+	fenceMargin      = 15 * time.Second // Time given to an evicted minion to shut down after its drain window, before reclaiming its state
+	drainWindow      = 30 * time.Second // Drain window of minions that do not report theirs
+	statsPeriod      = 15 * time.Second // Aggregate cluster stats with this period
+	httpTimeout      = 5 * time.Second  // Time allowed for http requests to minions
+	masterKey        = "master"         // Key to use as master lock for node upgrading
+	masterKeyExpires = 10               // Time (in seconds) to expire master lock key (should be longer than refreshPeriod)
 )
 
 // node implementation
@@ -26,25 +35,41 @@ type node struct {
 	sync.RWMutex
 	once     sync.Once
 	wg       sync.WaitGroup
-	cfg      *config.Config // Node config
-	master   bool           // Node is master
-	http     *http.Server   // HTTP server
-	redis    *predis.Client // Redis client
-	quitc    chan os.Signal // Quit channel
-	cleanupc chan struct{}  // Cleanup channel
+	jobsWg   sync.WaitGroup       // Wait group of master jobs
+	jobs     []job                // Jobs run while the node is master
+	termc    chan struct{}        // Closed when the current term of the node as master ends
+	healthMu sync.Mutex           // Guards failures and fenced
+	failures map[string]int       // Consecutive failed health probes by minion id
+	fenced   map[string]time.Time // Time the state of evicted minions may be reclaimed, by minion id
+	cfg      *config.Config       // Node config
+	id       string               // Node ID
+	master   bool                 // Node is master
+	fencing  int64                // Fencing token of the master lock held by the node
+	http     *http.Server         // HTTP server
+	client   *http.Client         // HTTP client for requests to minions
+	redis    *predis.Client       // Redis client
+	history  history.Store        // Conversation history store, nil if disabled
+	quitc    chan os.Signal       // Quit channel
+	cleanupc chan struct{}        // Cleanup channel
 }
 
 // New creates a new node.
 func New(cfg *config.Config) *node {
 	n := &node{
 		cfg:      cfg,
+		id:       uuid.NewV4().String(),
 		master:   false,
 		redis:    predis.New(cfg.RedisAddr),
+		client:   &http.Client{Timeout: httpTimeout},
+		failures: make(map[string]int),
+		fenced:   make(map[string]time.Time),
 		quitc:    make(chan os.Signal, 1),
 		cleanupc: make(chan struct{}, 1),
 	}
 
+	n.initJobs()
 	n.initServer()
+	n.registerMetrics()
 
 	return n
 }
@@ -63,6 +88,12 @@ func (n *node) Start() error {
 
 	log.Print("[info] connected to redis")
 
+	var err error
+
+	if n.history, err = history.New(n.cfg.HistoryBackend, n.redis, n.cfg.HistoryDir, n.cfg.HistoryMax); err != nil {
+		return err
+	}
+
 	task.New(n.upgrade, upgradePeriod, &n.wg, n.cleanupc)
 	task.New(n.maintain, maintainPeriod, &n.wg, n.cleanupc)
 
@@ -79,6 +110,16 @@ func (n *node) Cleanup() {
 		close(n.cleanupc)
 		n.wg.Wait()
 
+		// Let another node take over without waiting for the lock to expire
+		n.resign()
+		n.jobsWg.Wait()
+
+		if n.history != nil {
+			if err := n.history.Close(); err != nil {
+				log.Printf("[error] error closing history store: %v", err)
+			}
+		}
+
 		if err := n.redis.Close(); err != nil {
 			log.Printf("[error] error closing redis connection: %v", err)
 		}
@@ -87,77 +128,28 @@ func (n *node) Cleanup() {
 	})
 }
 
-// upgrade attempts to upgrade node to a master node by acquiring the master lock.
-// The lock is acquired if the node successfully sets the master key value in redis.
-func (n *node) upgrade() bool {
-	n.Lock()
-	defer n.Unlock()
-
-	if n.master {
-		return false
-	}
-
-	log.Print("[info] attempting to upgrade node to master...")
-
-	ok, err := n.redis.Set(
-		masterKey, 1,
-		"EX", masterKeyExpires,
-		"NX",
-	)
-
-	if err != nil {
-		log.Printf("[error] error acquiring master lock: %v", err)
-		return false
-	}
-
-	if ok {
-		log.Print("[info] acquired master lock, upgrading node to master...")
-		n.master = true
-		return false
-	}
-
-	return false
-}
-
-// maintain maintains control of master lock by extending the master key's expiration time.
-// If the node goes down, the master key will eventually expire and become available to other
-// nodes to acquire.
-func (n *node) maintain() bool {
-	n.Lock()
-	defer n.Unlock()
-
-	if !n.master {
-		return false
-	}
-
-	ok, err := n.redis.Expire(masterKey, masterKeyExpires)
-
-	if !ok || err != nil {
-		n.master = false
-	}
-
-	if err != nil {
-		log.Printf("[error] error extending master key expiration: %v", err)
-		return false
-	}
-
-	if !ok {
-		log.Printf("[warn] master key does not exist")
-		return false
-	}
-
-	return false
-}
-
 // initServer initializes the http server for the node.
 func (n *node) initServer() {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/healthz", n.wrapMiddleware(healthcheckHandler)).Methods("GET")
+	r.HandleFunc("/leader", n.wrapMiddleware(getLeaderHandler)).Methods("GET")
+	r.HandleFunc("/stats", n.wrapMiddleware(getStatsHandler)).Methods("GET")
 	r.HandleFunc("/minions", n.wrapMiddleware(getMinionsHandler)).Methods("GET")
 	r.HandleFunc("/minions/{id}", n.wrapMiddleware(getMinionHandler)).Methods("GET")
 	r.HandleFunc("/minions/{id}/send", n.wrapMiddleware(sendMessageHandler)).Methods("POST")
-	r.HandleFunc("/broadcast", n.wrapMiddleware(healthcheckHandler)).Methods("POST")
+	r.HandleFunc("/minions/{id}/control/{command}", n.wrapMiddleware(minionCommandHandler)).Methods("POST")
+	r.HandleFunc("/control/{command}", n.wrapMiddleware(clusterCommandHandler)).Methods("POST")
+	r.HandleFunc("/users/send", n.wrapMiddleware(sendToUsersHandler)).Methods("POST")
+	r.HandleFunc("/users/{id}/send", n.wrapMiddleware(sendToUserHandler)).Methods("POST")
+	r.HandleFunc("/users/{id}/sessions", n.wrapMiddleware(getUserSessionsHandler)).Methods("GET")
+	r.HandleFunc("/minions/{id}/sessions", n.wrapMiddleware(getMinionSessionsHandler)).Methods("GET")
+	r.HandleFunc("/sessions", n.wrapMiddleware(getAllSessionsHandler)).Methods("GET")
+	r.HandleFunc("/assign", n.wrapMiddleware(assignHandler)).Methods("GET")
+	r.HandleFunc("/broadcast", n.wrapMiddleware(broadcastMessageHandler)).Methods("POST")
+	r.HandleFunc("/history/{conversation}", n.wrapMiddleware(getHistoryHandler)).Methods("GET")
+	r.HandleFunc("/presence", n.wrapMiddleware(getStatusesHandler)).Methods("POST")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	n.http = &http.Server{
 		Handler: r,
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clientPrefix      = "client:"   // Prefix for client presence in redis
+	statusPrefix      = "status:"   // Prefix for client status in redis
+	statusKey         = "status"    // Key used to store client status
+	statusTextKey     = "text"      // Key used to store client custom status text
+	statusDeviceKey   = "device"    // Key used to store client device type
+	statusLastSeenKey = "last_seen" // Key used to store client last seen time (unix milliseconds)
+)
+
+// status implementation
+type status struct {
+	Online   bool   `json:"online"`              // Client has at least one connected session
+	Sessions int    `json:"sessions"`            // Connected sessions count
+	Status   string `json:"status,omitempty"`    // Client status
+	Text     string `json:"text,omitempty"`      // Client custom status text
+	Device   string `json:"device,omitempty"`    // Client device type
+	LastSeen int64  `json:"last_seen,omitempty"` // Client last seen time (unix milliseconds)
+}
+
+// getStatuses retrieves the presence and status of clients given an array of client ids.
+func (n *node) getStatuses(ids []string) (map[string]status, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if err := conn.Send("HLEN", clientPrefix+id); err != nil {
+			return nil, err
+		}
+
+		if err := conn.Send("HGETALL", statusPrefix+id); err != nil {
+			return nil, err
+		}
+	}
+
+	values, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]status, len(ids))
+
+	for i, id := range ids {
+		sessions, err := redis.Int(values[2*i], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := redis.StringMap(values[2*i+1], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		lastSeen, _ := strconv.ParseInt(fields[statusLastSeenKey], 10, 64)
+
+		result[id] = status{
+			Online:   sessions > 0,
+			Sessions: sessions,
+			Status:   fields[statusKey],
+			Text:     fields[statusTextKey],
+			Device:   fields[statusDeviceKey],
+			LastSeen: lastSeen,
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,237 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+	"github.com/pkg/errors"
+)
+
+const (
+	unhealthyKey = "unhealthy" // Key used to store the minion unhealthy flag
+)
+
+// markScript sets a field of a minion hash only if the minion is still registered,
+// so that the hash of a minion that just expired is not recreated without expiration.
+var markScript = newFencedScript(1, `
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// probe checks the liveness of every active minion over its /healthz endpoint.
+// Minions that fail consecutive probes are marked unhealthy, so that no client is
+// assigned to them, and are eventually evicted so that their presence and queues
+// are reclaimed by the sweep and recover jobs.
+func (n *node) probe(token int64) error {
+	minions, err := n.getMinions()
+
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, m := range minions {
+		wg.Add(1)
+
+		go func(m minion) {
+			defer wg.Done()
+
+			failures := n.recordProbe(m, n.probeMinion(m))
+
+			if !n.leads(token) {
+				return
+			}
+
+			if err := n.applyHealth(token, m, failures); err != nil {
+				log.Printf("[error] error updating health of minion %s: %v", m.ID, err)
+			}
+		}(m)
+	}
+
+	wg.Wait()
+
+	n.forgetMinions(minions)
+
+	return nil
+}
+
+// recordProbe records the outcome of a health probe of a minion. Returns the
+// number of consecutive failed probes of the minion.
+func (n *node) recordProbe(m minion, err error) int {
+	n.healthMu.Lock()
+	defer n.healthMu.Unlock()
+
+	if err == nil {
+		delete(n.failures, m.ID)
+		return 0
+	}
+
+	n.failures[m.ID]++
+	log.Printf("[warn] minion %s failed health probe (%d in a row): %v", m.ID, n.failures[m.ID], err)
+
+	return n.failures[m.ID]
+}
+
+// applyHealth marks a minion healthy or unhealthy given its consecutive failed
+// probes, and deregisters it once it reaches the eviction threshold.
+func (n *node) applyHealth(token int64, m minion, failures int) error {
+	if n.cfg.EvictAfter > 0 && failures >= n.cfg.EvictAfter {
+		return n.evict(token, m)
+	}
+
+	unhealthy := n.cfg.UnhealthyAfter > 0 && failures >= n.cfg.UnhealthyAfter
+
+	if unhealthy == m.Unhealthy {
+		return nil
+	}
+
+	flag := 0
+
+	if unhealthy {
+		log.Printf("[warn] marking minion %s as unhealthy", m.ID)
+		flag = 1
+	} else {
+		log.Printf("[info] minion %s is healthy again", m.ID)
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err := n.doFenced(conn, markScript, token, []interface{}{minionPrefix + m.ID}, unhealthyKey, flag)
+	return err
+}
+
+// evict deregisters an unresponsive minion. The minion is first asked to drain,
+// and shuts itself down once it finds its node key gone. Its presence and queues
+// are only reclaimed after it was given time to do so, see fencedMinions.
+func (n *node) evict(token int64, m minion) error {
+	log.Printf("[warn] evicting unresponsive minion %s", m.ID)
+
+	if err := n.requestDrain(m.ID); err != nil {
+		log.Printf("[warn] error asking minion %s to drain: %v", m.ID, err)
+	}
+
+	n.healthMu.Lock()
+	n.fenced[m.ID] = time.Now().Add(fenceWait(m))
+	n.healthMu.Unlock()
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err := n.doFenced(conn, fencedDelScript, token, []interface{}{minionPrefix + m.ID})
+	return err
+}
+
+// requestDrain sends a drain command to a minion without waiting for a reply.
+func (n *node) requestDrain(id string) error {
+	req, err := control.NewRequest(control.Drain, &control.DrainData{}, false)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := req.GetBytes()
+
+	if err != nil {
+		return err
+	}
+
+	return n.sendMessage(id, data)
+}
+
+// keptMinions gets the ids of minions whose presence and queues must be kept: the
+// given active minions, and evicted minions that may still be shutting down.
+func (n *node) keptMinions(active map[string]struct{}) map[string]struct{} {
+	fenced := n.fencedMinions()
+	ids := make(map[string]struct{}, len(active)+len(fenced))
+
+	for id := range active {
+		ids[id] = struct{}{}
+	}
+
+	for id := range fenced {
+		ids[id] = struct{}{}
+	}
+
+	return ids
+}
+
+// fencedMinions gets the ids of evicted minions that may still be shutting down,
+// whose presence and queues must not be reclaimed yet.
+func (n *node) fencedMinions() map[string]struct{} {
+	n.healthMu.Lock()
+	defer n.healthMu.Unlock()
+
+	ids := make(map[string]struct{}, len(n.fenced))
+
+	for id, until := range n.fenced {
+		if !time.Now().Before(until) {
+			delete(n.fenced, id)
+			continue
+		}
+
+		ids[id] = struct{}{}
+	}
+
+	return ids
+}
+
+// fenceWait gets the time given to an evicted minion to shut down, which is its
+// drain window plus a margin, as it may be draining its clients.
+func fenceWait(m minion) time.Duration {
+	window := drainWindow
+
+	if m.DrainWindow > 0 {
+		window = time.Duration(m.DrainWindow) * time.Millisecond
+	}
+
+	return window + fenceMargin
+}
+
+// forgetMinions forgets the probe failures of minions that left the cluster.
+func (n *node) forgetMinions(minions []minion) {
+	n.healthMu.Lock()
+	defer n.healthMu.Unlock()
+
+	for id := range n.failures {
+		if !hasMinion(minions, id) {
+			delete(n.failures, id)
+		}
+	}
+}
+
+// probeMinion probes the /healthz endpoint of a minion.
+func (n *node) probeMinion(m minion) error {
+	res, err := n.client.Get(fmt.Sprintf("http://%s:%s/healthz", m.IP, m.Port))
+
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// hasMinion checks if a list of minions contains a minion by its id.
+func hasMinion(minions []minion, id string) bool {
+	for _, m := range minions {
+		if m.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
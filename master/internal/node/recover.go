@@ -0,0 +1,185 @@
+package node
+
+import (
+	"log"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+)
+
+const (
+	peerPrefix   = "peer:" // Prefix for peer message queue in redis
+	recoverBatch = 100     // Max messages sent to a minion per recover command
+)
+
+// reclaim reclaims the presence and queues of minions whose node key has expired.
+// Presence is swept before queues are recovered in the same run, so that recovered
+// messages are not routed back to the queue of the minion they came from. Evicted
+// minions that may still be shutting down are left alone.
+func (n *node) reclaim(token int64) error {
+	active, err := n.getMinionIDs()
+
+	if err != nil {
+		return err
+	}
+
+	alive := n.keptMinions(active)
+
+	if err := n.sweep(token, alive); err != nil {
+		return err
+	}
+
+	return n.recoverQueues(token, alive)
+}
+
+// recoverQueues recovers the message queues of minions that are not alive. Messages
+// queued for the users of a dead minion are routed again by an active minion, and
+// control requests queued for it are discarded.
+func (n *node) recoverQueues(token int64, alive map[string]struct{}) error {
+	target, err := n.recoveryTarget()
+
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{peerPrefix, messagePrefix} {
+		keys, err := n.redis.GetKeys(prefix + "*")
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, prefix)
+
+			if _, ok := alive[id]; ok {
+				continue
+			}
+
+			if !n.leads(token) {
+				return nil
+			}
+
+			if prefix == messagePrefix {
+				if err := n.discardQueue(token, id); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			// Leave the queue for later if there is nobody to route it
+			if target == "" {
+				continue
+			}
+
+			if err := n.recoverQueue(token, id, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// recoveryTarget selects the minion that routes recovered messages, the least loaded
+// minion that is neither draining nor unhealthy. Returns an empty id if there is none.
+func (n *node) recoveryTarget() (string, error) {
+	minions, err := n.getMinions()
+
+	if err != nil {
+		return "", err
+	}
+
+	for i := range minions {
+		// Minions that do not report their limit get the configured one
+		if minions[i].Capacity == 0 {
+			minions[i].Capacity = n.cfg.MaxConnections
+		}
+	}
+
+	m := leastLoaded(minions, func(m minion) bool { return !m.Draining && !m.Unhealthy })
+
+	if m == nil {
+		return "", nil
+	}
+
+	return m.ID, nil
+}
+
+// recoverQueue moves the peer queue of a dead minion to a live minion in batches,
+// which routes the messages to their recipients.
+func (n *node) recoverQueue(token int64, id string, target string) error {
+	for {
+		messages, err := n.popQueue(token, peerPrefix+id, recoverBatch)
+
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
+
+		if _, err := n.command(target, control.Recover, &control.RecoverData{
+			Minion:   id,
+			Messages: messages,
+		}); err != nil {
+			// Put the messages back so they are not lost
+			if err := n.pushQueue(peerPrefix+id, messages); err != nil {
+				log.Printf("[error] error requeueing messages of expired minion %s: %v", id, err)
+			}
+
+			return err
+		}
+	}
+}
+
+// discardQueue discards the control requests queued for a dead minion, logging
+// each dropped request.
+func (n *node) discardQueue(token int64, id string) error {
+	requests, err := n.popQueue(token, messagePrefix+id, 0)
+
+	if err != nil {
+		return err
+	}
+
+	for _, data := range requests {
+		req, err := control.RequestFromBytes(data)
+
+		if err != nil {
+			log.Printf("[warn] discarded unreadable control request of expired minion %s: %v", id, err)
+			continue
+		}
+
+		log.Printf("[warn] discarded %s control request %s of expired minion %s", req.Command, req.ID, id)
+	}
+
+	return nil
+}
+
+// popQueue removes and returns up to count messages from the head of a queue, or
+// every message if count is zero, on behalf of the master term of a fencing token.
+func (n *node) popQueue(token int64, key string, count int) ([][]byte, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(n.doFenced(conn, fencedPopScript, token, []interface{}{key}, count))
+}
+
+// pushQueue pushes messages back to the head of a queue, keeping their order.
+func (n *node) pushQueue(key string, messages [][]byte) error {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(messages)+1)
+	args = append(args, key)
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		args = append(args, messages[i])
+	}
+
+	_, err := conn.Do("LPUSH", args...)
+	return err
+}
@@ -2,11 +2,22 @@ package node
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/makeshiftsoftware/vsnet/pkg/auth"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+	"github.com/makeshiftsoftware/vsnet/pkg/history"
+)
+
+const (
+	maxPageSize = 500 // Maximum number of sessions per page
 )
 
 // handler represents a custom http route handler function.
@@ -30,6 +41,36 @@ func healthcheckHandler(n *node, w http.ResponseWriter, r *http.Request) error {
 	return n.redis.Ping()
 }
 
+// getLeaderHandler is an http handler function that retrieves the current master node.
+func getLeaderHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	l, err := n.getLeader()
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, l)
+}
+
+// getStatsHandler is an http handler function that retrieves the last aggregated cluster stats.
+func getStatsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	stats, err := n.getStats()
+
+	if err != nil {
+		return err
+	}
+
+	if stats == nil {
+		http.Error(w, "cluster stats are not available yet", http.StatusNotFound)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(stats)
+
+	return err
+}
+
 // getMinionsHandler is an http handler function that retrieves all active minions.
 func getMinionsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
 	var minions []minion
@@ -80,14 +121,340 @@ func sendMessageHandler(n *node, w http.ResponseWriter, r *http.Request) error {
 	return n.sendMessage(mux.Vars(r)["id"], b)
 }
 
-// broadcastMessageHandler is an http handler function that broadcasts a message to all active minions.
+// broadcastMessageHandler is an http handler function that broadcasts a message to every client
+// session, or to the sessions matching the filters of the request, and responds with per-minion
+// delivery counts. The request body is a JSON broadcast request.
 func broadcastMessageHandler(n *node, w http.ResponseWriter, r *http.Request) error {
-	b, err := ioutil.ReadAll(r.Body)
+	var req broadcastRequest
+
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	res, err := n.broadcast(&req)
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, res)
+}
+
+// getHistoryHandler is an http handler function that retrieves a page of conversation history.
+// Pages are requested with the before (cursor) and limit query parameters.
+func getHistoryHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	if n.history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return nil
+	}
+
+	q := r.URL.Query()
+	before, err := history.ParseCursor(q.Get("before"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	page, err := n.history.Page(mux.Vars(r)["conversation"], before, limit)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := json.Marshal(page)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(res)
+
+	return err
+}
+
+// getStatusesHandler is an http handler function that retrieves the presence and status of
+// many clients at once. The request body is a JSON array of client ids.
+func getStatusesHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	var ids []string
+
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	statuses, err := n.getStatuses(ids)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := json.Marshal(statuses)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(res)
+
+	return err
+}
+
+// minionCommandHandler is an http handler function that runs a control command on a minion by
+// its id and responds with the minion's result. The request body is the JSON command payload.
+func minionCommandHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	cmd, payload, ok := commandRequest(w, r)
+
+	if !ok {
+		return nil
+	}
+
+	vars := mux.Vars(r)
+	res := commandResult{Minion: vars["id"]}
+
+	switch result, err := n.command(vars["id"], cmd, payload); err {
+	case nil:
+		res.Result = result
+	case ErrMinionNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	case ErrControlTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return nil
+	default:
+		res.Error = err.Error()
+	}
+
+	return writeJSON(w, res)
+}
+
+// clusterCommandHandler is an http handler function that runs a control command on every active
+// minion and responds with the result of each minion. The request body is the JSON command payload.
+func clusterCommandHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	cmd, payload, ok := commandRequest(w, r)
+
+	if !ok {
+		return nil
+	}
+
+	results, err := n.commandAll(cmd, payload)
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, results)
+}
+
+// commandRequest parses the control command and JSON payload of a request. Responds with an
+// error and returns false if the request is invalid.
+func commandRequest(w http.ResponseWriter, r *http.Request) (control.Command, interface{}, bool) {
+	defer r.Body.Close()
+
+	cmd, err := control.ParseCommand(mux.Vars(r)["command"])
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return 0, nil, false
+	}
+
+	payload := cmd.Payload()
+
+	if payload == nil {
+		return cmd, nil, true
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(payload); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	return cmd, payload, true
+}
+
+// writeJSON writes a JSON encoded response.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	res, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(res)
+
+	return err
+}
+
+// sendToUserHandler is an http handler function that sends a message to every session of a user.
+// The request body is a JSON send request.
+func sendToUserHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	var req sendRequest
+
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	req.Users = []string{mux.Vars(r)["id"]}
+
+	res, err := n.sendToUsers(&req)
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, res)
+}
+
+// sendToUsersHandler is an http handler function that sends a message to every session of many
+// users at once. The request body is a JSON send request listing the users.
+func sendToUsersHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	var req sendRequest
+
 	defer r.Body.Close()
 
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if len(req.Users) == 0 {
+		http.Error(w, "no recipient users", http.StatusBadRequest)
+		return nil
+	}
+
+	res, err := n.sendToUsers(&req)
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, res)
+}
+
+// getUserSessionsHandler is an http handler function that retrieves the sessions of a user.
+func getUserSessionsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	sessions, err := n.getUserSessions(mux.Vars(r)["id"])
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, sessions)
+}
+
+// getMinionSessionsHandler is an http handler function that retrieves a page of the sessions of a
+// minion by its id. Pages are requested with the offset and limit query parameters.
+func getMinionSessionsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	offset, limit := pagination(r)
+
+	page, err := n.getMinionSessions(mux.Vars(r)["id"], offset, limit)
+
+	if err == ErrMinionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, page)
+}
+
+// getAllSessionsHandler is an http handler function that retrieves a page of the sessions of every
+// active minion. Pages are requested with the offset and limit query parameters.
+func getAllSessionsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	offset, limit := pagination(r)
+
+	pages, err := n.getAllSessions(offset, limit)
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, pages)
+}
+
+// pagination gets the offset and limit query parameters of a request.
+func pagination(r *http.Request) (int, int) {
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return offset, limit
+}
+
+// assignHandler is an http handler function that assigns an authenticated client to the least
+// loaded minion, responding with the minion address and a connection ticket for it. Minions can
+// be restricted to a region with the region query parameter, and the sticky query parameter
+// prefers a minion already hosting a session of the client.
+func assignHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	key, err := auth.NewAccessKey(accessToken(r), &n.cfg.Secret)
+
+	if err != nil {
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	// Tickets are only exchanged for access tokens, so that tickets cannot outlive them
+	if key.IsTicket() {
+		http.Error(w, auth.ErrTicketNotAllowed.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	q := r.URL.Query()
+	sticky, _ := strconv.ParseBool(q.Get("sticky"))
+
+	m, err := n.assign(key.ID, q.Get("region"), sticky)
+
+	if err == ErrNoMinionAvailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ticket, err := auth.NewTicket(key, m.ID, n.cfg.TicketTTL, &n.cfg.Secret)
+
 	if err != nil {
 		return err
 	}
 
-	return n.broadcastMessage(b)
+	return writeJSON(w, &assignment{
+		Minion:  m.ID,
+		Address: m.IP + ":" + m.Port,
+		Ticket:  ticket,
+		Expires: time.Now().Add(n.cfg.TicketTTL).Unix(),
+	})
+}
+
+// accessToken gets the access token of a request from the authorization header,
+// or from the token query parameter for clients that cannot set headers.
+func accessToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+
+	return r.URL.Query().Get("token")
 }
@@ -0,0 +1,39 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSendToUsersHandlerRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*node, http.ResponseWriter, *http.Request) error
+		body    string
+	}{
+		{name: "batch without users", handler: sendToUsersHandler, body: `{"data": "aGk="}`},
+		{name: "batch with empty users", handler: sendToUsersHandler, body: `{"users": [], "data": "aGk="}`},
+		{name: "batch invalid json", handler: sendToUsersHandler, body: `{"users": [`},
+		{name: "user invalid json", handler: sendToUserHandler, body: `not json`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.SetURLVars(httptest.NewRequest("POST", "/users/send", strings.NewReader(tt.body)), map[string]string{"id": "alice"})
+			w := httptest.NewRecorder()
+
+			// Rejected requests never reach the node
+			if err := tt.handler(nil, w, r); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
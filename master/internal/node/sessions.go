@@ -0,0 +1,188 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionInfoPrefix = "session:" // Prefix for session metadata in redis
+)
+
+// session is the metadata of a client session
+type session struct {
+	Session     string `redis:"-" json:"session"`                       // Session ID
+	User        string `redis:"user" json:"user"`                       // Client ID
+	Minion      string `redis:"minion" json:"minion"`                   // Minion hosting the session
+	ConnectedAt int64  `redis:"connected_at" json:"connected_at"`       // Connect time (unix milliseconds)
+	RemoteAddr  string `redis:"remote_addr" json:"remote_addr"`         // Client IP address
+	UserAgent   string `redis:"user_agent" json:"user_agent,omitempty"` // Client user agent
+	Protocol    string `redis:"protocol" json:"protocol,omitempty"`     // Negotiated websocket subprotocol
+	Version     string `redis:"version" json:"version,omitempty"`       // Client protocol version
+	Device      string `redis:"device" json:"device,omitempty"`         // Client device type
+}
+
+// sessionPage is a page of the sessions of a minion
+type sessionPage struct {
+	Minion   string     `json:"minion,omitempty"` // Minion ID
+	Sessions []*session `json:"sessions"`         // Page sessions
+	Offset   int        `json:"offset"`           // Offset of the first session of the page
+	Total    int        `json:"total"`            // Total number of sessions
+	Error    string     `json:"error,omitempty"`  // Error, empty if the page was retrieved
+}
+
+// getUserSessions retrieves the sessions of a client, oldest first.
+func (n *node) getUserSessions(id string) ([]*session, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	if err := conn.Send("ZRANGE", sessionPrefix+id, 0, -1, "WITHSCORES"); err != nil {
+		return nil, err
+	}
+
+	if err := conn.Send("HGETALL", clientPrefix+id); err != nil {
+		return nil, err
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := redis.Strings(result[0], nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	locations, err := redis.StringMap(result[1], nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*session, 0, len(locations))
+
+	// Sorted set replies alternate session ids and connect times
+	for i := 0; i+1 < len(order); i += 2 {
+		minion, ok := locations[order[i]]
+
+		if !ok {
+			continue
+		}
+
+		connected, _ := strconv.ParseInt(order[i+1], 10, 64)
+
+		sessions = append(sessions, &session{
+			Session:     order[i],
+			User:        id,
+			Minion:      minion,
+			ConnectedAt: connected,
+		})
+
+		if err := conn.Send("HGETALL", sessionInfoPrefix+order[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Metadata is left empty for sessions of minions that do not record it
+	for _, s := range sessions {
+		values, err := redis.Values(conn.Receive())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := redis.ScanStruct(values, s); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+// getMinionSessions retrieves a page of the sessions of a minion from the /clients endpoint
+// of its admin listener.
+func (n *node) getMinionSessions(id string, offset int, limit int) (*sessionPage, error) {
+	m, err := n.getMinion(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+
+	res, err := n.client.Get(fmt.Sprintf("http://%s:%s/clients?%s", m.IP, m.AdminPort, q.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("minion %s responded with status %d", id, res.StatusCode)
+	}
+
+	page := &sessionPage{Minion: id}
+
+	if err := json.NewDecoder(res.Body).Decode(page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// getAllSessions retrieves a page of the sessions of every active minion.
+func (n *node) getAllSessions(offset int, limit int) ([]*sessionPage, error) {
+	ids, err := n.getMinionIDs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	pages := make([]*sessionPage, 0, len(ids))
+
+	for id := range ids {
+		wg.Add(1)
+
+		go func(id string) {
+			defer wg.Done()
+
+			page, err := n.getMinionSessions(id, offset, limit)
+
+			if err != nil {
+				page = &sessionPage{Minion: id, Offset: offset, Error: err.Error()}
+			}
+
+			mu.Lock()
+			pages = append(pages, page)
+			mu.Unlock()
+		}(id)
+	}
+
+	wg.Wait()
+
+	return pages, nil
+}
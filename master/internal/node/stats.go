@@ -0,0 +1,90 @@
+package node
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+)
+
+const (
+	statsKey     = "cluster_stats" // Key of the aggregated cluster stats in redis
+	statsExpires = 60              // Time (in seconds) to expire aggregated cluster stats
+)
+
+// clusterStats is the aggregate of the stats of every active minion
+type clusterStats struct {
+	Minions     int             `json:"minions"`      // Active minions
+	Responding  int             `json:"responding"`   // Minions that reported their stats
+	Draining    int             `json:"draining"`     // Draining minions
+	Connections int64           `json:"connections"`  // Connections count
+	Sessions    int             `json:"sessions"`     // Connected sessions
+	Evictions   uint64          `json:"evictions"`    // Slow consumer evictions
+	Dropped     uint64          `json:"dropped"`      // Slow consumer dropped messages
+	Limited     uint64          `json:"rate_limited"` // Rate limited messages
+	UpdatedAt   int64           `json:"updated_at"`   // Aggregation time (unix milliseconds)
+	PerMinion   []commandResult `json:"per_minion"`   // Stats of each minion
+}
+
+// aggregateStats collects the stats of every active minion and stores their
+// aggregate, so that any master node can serve it.
+func (n *node) aggregateStats(token int64) error {
+	results, err := n.commandAll(control.ReportStats, nil)
+
+	if err != nil {
+		return err
+	}
+
+	stats := &clusterStats{
+		Minions:   len(results),
+		UpdatedAt: time.Now().UnixNano() / int64(time.Millisecond),
+		PerMinion: results,
+	}
+
+	for _, r := range results {
+		s, ok := r.Result.(*control.StatsData)
+
+		if !ok {
+			continue
+		}
+
+		stats.Responding++
+		stats.Connections += s.Connections
+		stats.Sessions += s.Sessions
+		stats.Evictions += s.Evictions
+		stats.Dropped += s.Dropped
+		stats.Limited += s.Limited
+
+		if s.Draining {
+			stats.Draining++
+		}
+	}
+
+	data, err := json.Marshal(stats)
+
+	if err != nil {
+		return err
+	}
+
+	if !n.leads(token) {
+		return nil
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err = n.doFenced(conn, fencedSetScript, token, []interface{}{statsKey}, data, statsExpires)
+	return err
+}
+
+// getStats retrieves the last aggregated cluster stats. Returns nil if none were aggregated.
+func (n *node) getStats() (json.RawMessage, error) {
+	data, err := redis.Bytes(n.redis.Get(statsKey))
+
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	return data, err
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"log"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	sessionPrefix = "sessions:" // Prefix for client session connect order in redis
+	roomPrefix    = "room:"     // Prefix for room membership in redis
+	watchPrefix   = "watch:"    // Prefix for presence subscriptions in redis
+)
+
+// sweepScript removes a client session from presence only if it is still hosted
+// by the given minion, so that a session resumed elsewhere meanwhile is kept.
+var sweepScript = newFencedScript(3, `
+if redis.call("HGET", KEYS[2], ARGV[2]) == ARGV[3] then
+	redis.call("HDEL", KEYS[2], ARGV[2])
+	redis.call("ZREM", KEYS[3], ARGV[2])
+	redis.call("DEL", KEYS[4])
+	return 1
+end
+return 0
+`)
+
+// sweep purges presence entries, room memberships and presence subscriptions of
+// minions that are not alive.
+func (n *node) sweep(token int64, alive map[string]struct{}) error {
+	var purged int
+
+	for _, prefix := range []string{clientPrefix, roomPrefix, watchPrefix} {
+		if !n.leads(token) {
+			break
+		}
+
+		count, err := n.sweepPrefix(token, prefix, alive)
+
+		if err == ErrNotMaster {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("[error] error sweeping %s keys: %v", prefix, err)
+		}
+
+		purged += count
+	}
+
+	if purged > 0 {
+		log.Printf("[info] swept %d stale entries of expired minions", purged)
+	}
+
+	return nil
+}
+
+// sweepPrefix purges the fields of hashes matching a key prefix whose value
+// (for client presence) or field (for rooms and subscriptions) is the id of a
+// minion that is not alive. Returns the number of purged entries.
+func (n *node) sweepPrefix(token int64, prefix string, alive map[string]struct{}) (int, error) {
+	keys, err := n.redis.GetKeys(prefix + "*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	purged := 0
+
+	for _, key := range keys {
+		entries, err := redis.StringMap(conn.Do("HGETALL", key))
+
+		if err != nil {
+			return purged, err
+		}
+
+		for field, value := range entries {
+			minion := field
+
+			// Client presence maps session ids to minion ids
+			if prefix == clientPrefix {
+				minion = value
+			}
+
+			if _, ok := alive[minion]; ok {
+				continue
+			}
+
+			if prefix == clientPrefix {
+				id := strings.TrimPrefix(key, clientPrefix)
+				keys := []interface{}{key, sessionPrefix + id, sessionInfoPrefix + field}
+				ok, err := redis.Bool(n.doFenced(conn, sweepScript, token, keys, field, value))
+
+				if err != nil {
+					return purged, err
+				}
+
+				if ok {
+					purged++
+				}
+
+				continue
+			}
+
+			if _, err := n.doFenced(conn, fencedHdelScript, token, []interface{}{key}, field); err != nil {
+				return purged, err
+			}
+
+			purged++
+		}
+	}
+
+	return purged, nil
+}
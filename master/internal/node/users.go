@@ -0,0 +1,152 @@
+package node
+
+import (
+	"log"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+	uuid "github.com/satori/go.uuid"
+)
+
+// sendRequest is a message sent to users through the master
+type sendRequest struct {
+	Users []string `json:"users,omitempty"` // Recipient user IDs (batch requests only)
+	Type  uint8    `json:"type,omitempty"`  // Message type
+	Data  []byte   `json:"data"`            // Message data
+	Store bool     `json:"store,omitempty"` // Store the message for offline recipients
+}
+
+// sendResult is the result of a message sent to users
+type sendResult struct {
+	ID        string          `json:"id"`               // Message ID
+	Delivered int             `json:"delivered"`        // Sessions the message was delivered to
+	Offline   []string        `json:"offline"`          // Recipients without any connected session
+	Stored    []string        `json:"stored,omitempty"` // Offline recipients the message was stored for
+	Minions   []commandResult `json:"minions"`          // Result of each minion hosting a recipient
+}
+
+// sendToUsers delivers a message from the system sender to every session of its
+// recipients. Recipients that are offline are reported, and the message is stored
+// for them if requested.
+func (n *node) sendToUsers(req *sendRequest) (*sendResult, error) {
+	locations, offline, err := n.locateUsers(req.Users)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &sendResult{
+		ID:      uuid.NewV4().String(),
+		Offline: offline,
+	}
+
+	payloads := make(map[string]interface{}, len(locations))
+
+	for id, users := range locations {
+		payloads[id] = &control.DeliverData{
+			ID:     res.ID,
+			Users:  users,
+			Type:   req.Type,
+			Sender: n.cfg.SystemSender,
+			Data:   req.Data,
+		}
+	}
+
+	res.Minions = n.commandEach(control.Deliver, payloads)
+
+	for _, r := range res.Minions {
+		if count, ok := r.Result.(*control.CountData); ok {
+			res.Delivered += count.Count
+		}
+	}
+
+	if !req.Store || len(offline) == 0 {
+		return res, nil
+	}
+
+	// Any minion can store messages for offline users, so try each until one does.
+	// Minions store for every user or none, so a minion that replied with an error
+	// stored nothing and the next one can be tried.
+	ids, err := n.getMinionIDs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	store := &control.DeliverData{
+		ID:     res.ID,
+		Store:  offline,
+		Type:   req.Type,
+		Sender: n.cfg.SystemSender,
+		Data:   req.Data,
+	}
+
+	for id := range ids {
+		result, err := n.command(id, control.Deliver, store)
+
+		// A minion that did not reply in time may still store the message
+		if err == ErrControlTimeout {
+			log.Printf("[warn] minion %s did not confirm storing message for offline users, not retrying", id)
+			break
+		}
+
+		if err != nil {
+			log.Printf("[warn] minion %s could not store message for offline users: %v", id, err)
+			continue
+		}
+
+		if count, ok := result.(*control.CountData); ok && count.Stored <= len(offline) {
+			res.Stored = offline[:count.Stored]
+		}
+
+		break
+	}
+
+	return res, nil
+}
+
+// locateUsers finds the minions hosting sessions of users. The result will be a map
+// where each key is a minion id and each value is a list of users with at least one
+// session on that minion, and a list of users without any session.
+func (n *node) locateUsers(users []string) (map[string][]string, []string, error) {
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range users {
+		if err := conn.Send("HVALS", clientPrefix+id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	values, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locations := make(map[string][]string)
+	offline := make([]string, 0)
+
+	for i, val := range values {
+		hosts, err := redis.Strings(val, nil)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(hosts) == 0 {
+			offline = append(offline, users[i])
+			continue
+		}
+
+		for id := range toSet(hosts) {
+			locations[id] = append(locations[id], users[i])
+		}
+	}
+
+	return locations, offline, nil
+}
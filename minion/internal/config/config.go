@@ -1,35 +1,151 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 // Environment variable names
 const (
-	envExternalIP     = "EXTERNAL_IP"
-	envPort           = "PORT"
-	envSecret         = "SECRET"
-	envMaxConnections = "MAX_CONNECTIONS"
-	envMaxMessageSize = "MAX_MESSAGE_SIZE"
-	envRedisAddr      = "REDIS_ADDR"
+	envExternalIP        = "EXTERNAL_IP"
+	envPort              = "PORT"
+	envAdminPort         = "ADMIN_PORT"
+	envSecret            = "SECRET"
+	envMaxConnections    = "MAX_CONNECTIONS"
+	envMaxMessageSize    = "MAX_MESSAGE_SIZE"
+	envRedisAddr         = "REDIS_ADDR"
+	envCompression       = "COMPRESSION"
+	envBatchMaxSize      = "BATCH_MAX_SIZE"
+	envOutboundBuffer    = "OUTBOUND_BUFFER_SIZE"
+	envSlowConsumer      = "SLOW_CONSUMER_POLICY"
+	envReadBufferSize    = "READ_BUFFER_SIZE"
+	envWriteBufferSize   = "WRITE_BUFFER_SIZE"
+	envWriteWait         = "WRITE_WAIT"
+	envPongWait          = "PONG_WAIT"
+	envPingPeriod        = "PING_PERIOD"
+	envMessageSizeLimits = "MESSAGE_SIZE_LIMITS"
+	envRoleLimits        = "ROLE_LIMITS"
+	envMaxSessions       = "MAX_SESSIONS_PER_USER"
+	envSessionTakeover   = "SESSION_TAKEOVER"
+	envOfflineQuota      = "OFFLINE_QUOTA"
+	envOfflineTTL        = "OFFLINE_TTL"
+	envHistoryBackend    = "HISTORY_BACKEND"
+	envHistoryDir        = "HISTORY_DIR"
+	envHistoryMaxEntries = "HISTORY_MAX_ENTRIES"
+	envReplaySize        = "REPLAY_SIZE"
+	envReplayTTL         = "REPLAY_TTL"
+	envMessageRate       = "MESSAGE_RATE"
+	envMessageBurst      = "MESSAGE_BURST"
+	envByteRate          = "BYTE_RATE"
+	envByteBurst         = "BYTE_BURST"
+	envMaxRecipients     = "MAX_RECIPIENTS"
+	envMaxRooms          = "MAX_ROOMS"
+	envMaxWatching       = "MAX_WATCHING"
+	envUserMessageRate   = "USER_MESSAGE_RATE"
+	envRateLimitAction   = "RATE_LIMIT_ACTION"
+	envDrainWindow       = "DRAIN_WINDOW"
+	envRegion            = "REGION"
+	envTrustedProxies    = "TRUSTED_PROXIES"
+)
+
+// Slow consumer policies
+const (
+	SlowConsumerDisconnect = "disconnect"  // Disconnect the client with a close code
+	SlowConsumerDropOldest = "drop_oldest" // Drop the oldest queued message
+	SlowConsumerDropNewest = "drop_newest" // Drop the message being delivered
+	SlowConsumerSpill      = "spill"       // Disconnect the client and spill queued messages to the offline store
+)
+
+// Rate limit actions, applied when a client exceeds its rate limits
+const (
+	RateLimitError      = "error"      // Reply with an error message and drop the message
+	RateLimitDisconnect = "disconnect" // Disconnect the client with a close code
+)
+
+// Session takeover policies, applied when a user at the session limit connects
+const (
+	SessionTakeoverReject      = "reject"       // Refuse the new session
+	SessionTakeoverEvictOldest = "evict_oldest" // Disconnect the oldest session
 )
 
 // Default config
 var defaults = map[string]interface{}{
-	(envExternalIP):     ":",
-	(envPort):           "8080",
-	(envSecret):         "secret",
-	(envMaxConnections): 255,
-	(envMaxMessageSize): 512,
-	(envRedisAddr):      ":6379",
+	(envExternalIP):        ":",
+	(envPort):              "8080",
+	(envAdminPort):         "9090",
+	(envSecret):            "secret",
+	(envMaxConnections):    255,
+	(envMaxMessageSize):    512,
+	(envRedisAddr):         ":6379",
+	(envCompression):       false,
+	(envBatchMaxSize):      16384,
+	(envOutboundBuffer):    256,
+	(envSlowConsumer):      SlowConsumerDisconnect,
+	(envReadBufferSize):    1024,
+	(envWriteBufferSize):   1024,
+	(envWriteWait):         "10s",
+	(envPongWait):          "60s",
+	(envPingPeriod):        "54s",
+	(envMessageSizeLimits): "",
+	(envRoleLimits):        "",
+	(envMaxSessions):       0,
+	(envSessionTakeover):   SessionTakeoverEvictOldest,
+	(envOfflineQuota):      100,
+	(envOfflineTTL):        "72h",
+	(envHistoryBackend):    "",
+	(envHistoryDir):        "history",
+	(envHistoryMaxEntries): 10000,
+	(envReplaySize):        100,
+	(envReplayTTL):         "2m",
+	(envMessageRate):       20,
+	(envMessageBurst):      40,
+	(envByteRate):          65536,
+	(envByteBurst):         131072,
+	(envMaxRecipients):     100,
+	(envMaxRooms):          100,
+	(envMaxWatching):       1000,
+	(envUserMessageRate):   0,
+	(envRateLimitAction):   RateLimitError,
+	(envDrainWindow):       "30s",
+	(envRegion):            "",
+	(envTrustedProxies):    "",
 }
 
 // Config implementation
 type Config struct {
-	ExternalIP     string
-	Port           string
-	Secret         []byte
-	MaxConnections int64
-	MaxMessageSize int64
-	RedisAddr      string
+	limitsMu        sync.RWMutex // Guards Limits and RoleLimits, which can be updated at runtime
+	ExternalIP      string
+	Port            string
+	AdminPort       string // Port of the admin listener, not to be exposed to clients (9090 by default, clear of the master on 8081)
+	Secret          []byte
+	MaxConnections  int64
+	RedisAddr       string
+	Compression     bool
+	BatchMaxSize    int
+	SlowConsumer    string
+	ReadBufferSize  int
+	WriteBufferSize int
+	Limits          Limits                    // Default per-connection limits
+	RoleLimits      map[string]LimitsOverride // Per-connection limit overrides by user role
+	MaxSessions     int                       // Max concurrent sessions per user (zero is unlimited)
+	SessionTakeover string                    // Policy applied when a user exceeds MaxSessions
+	OfflineQuota    int                       // Max messages stored per offline user (zero disables the offline store)
+	OfflineTTL      time.Duration             // Time to keep messages for offline users
+	HistoryBackend  string                    // Conversation history backend (empty disables history, file is for a single minion only)
+	HistoryDir      string                    // Directory for the file history backend
+	HistoryMax      int                       // Max history entries kept per conversation
+	ReplaySize      int                       // Max messages kept for replay per resumable session (zero disables resumption)
+	ReplayTTL       time.Duration             // Time a session can be resumed after its last message
+	UserMessageRate int                       // Messages per second allowed per user across the cluster (zero is unlimited)
+	RateLimit       string                    // Action applied when a client exceeds its rate limits
+	DrainWindow     time.Duration             // Time over which sessions are closed when draining
+	Region          string                    // Region tag used by the master to assign clients
+	TrustedProxies  []*net.IPNet              // Proxies whose X-Forwarded-For entries are trusted
 }
 
 // New creates a new node config.
@@ -42,12 +158,115 @@ func New() *Config {
 
 	v.AutomaticEnv()
 
-	return &Config{
-		ExternalIP:     v.GetString(envExternalIP),
-		Port:           v.GetString(envPort),
-		Secret:         []byte(v.GetString(envSecret)),
-		MaxConnections: v.GetInt64(envMaxConnections),
-		MaxMessageSize: v.GetInt64(envMaxMessageSize),
-		RedisAddr:      v.GetString(envRedisAddr),
+	cfg := &Config{
+		ExternalIP:      v.GetString(envExternalIP),
+		Port:            v.GetString(envPort),
+		AdminPort:       v.GetString(envAdminPort),
+		Secret:          []byte(v.GetString(envSecret)),
+		MaxConnections:  v.GetInt64(envMaxConnections),
+		RedisAddr:       v.GetString(envRedisAddr),
+		Compression:     v.GetBool(envCompression),
+		BatchMaxSize:    v.GetInt(envBatchMaxSize),
+		SlowConsumer:    v.GetString(envSlowConsumer),
+		ReadBufferSize:  v.GetInt(envReadBufferSize),
+		WriteBufferSize: v.GetInt(envWriteBufferSize),
+		MaxSessions:     v.GetInt(envMaxSessions),
+		SessionTakeover: v.GetString(envSessionTakeover),
+		OfflineQuota:    v.GetInt(envOfflineQuota),
+		OfflineTTL:      v.GetDuration(envOfflineTTL),
+		HistoryBackend:  v.GetString(envHistoryBackend),
+		HistoryDir:      v.GetString(envHistoryDir),
+		HistoryMax:      v.GetInt(envHistoryMaxEntries),
+		ReplaySize:      v.GetInt(envReplaySize),
+		ReplayTTL:       v.GetDuration(envReplayTTL),
+		UserMessageRate: v.GetInt(envUserMessageRate),
+		RateLimit:       v.GetString(envRateLimitAction),
+		DrainWindow:     v.GetDuration(envDrainWindow),
+		Region:          v.GetString(envRegion),
+		Limits: Limits{
+			MaxMessageSize: v.GetInt64(envMaxMessageSize),
+			OutboundBuffer: v.GetInt(envOutboundBuffer),
+			WriteWait:      v.GetDuration(envWriteWait),
+			PongWait:       v.GetDuration(envPongWait),
+			PingPeriod:     v.GetDuration(envPingPeriod),
+			MessageRate:    v.GetFloat64(envMessageRate),
+			MessageBurst:   v.GetInt(envMessageBurst),
+			ByteRate:       v.GetFloat64(envByteRate),
+			ByteBurst:      v.GetInt(envByteBurst),
+			MaxRecipients:  v.GetInt(envMaxRecipients),
+			MaxRooms:       v.GetInt(envMaxRooms),
+			MaxWatching:    v.GetInt(envMaxWatching),
+		},
+	}
+
+	if err := parseJSON(v.GetString(envMessageSizeLimits), &cfg.Limits.MessageSizes); err != nil {
+		log.Printf("[warn] ignoring invalid %s: %v", envMessageSizeLimits, err)
+	}
+
+	if err := parseJSON(v.GetString(envRoleLimits), &cfg.RoleLimits); err != nil {
+		log.Printf("[warn] ignoring invalid %s: %v", envRoleLimits, err)
+	}
+
+	proxies, err := parseNetworks(v.GetString(envTrustedProxies))
+
+	if err != nil {
+		log.Printf("[warn] ignoring invalid %s: %v", envTrustedProxies, err)
+	}
+
+	cfg.TrustedProxies = proxies
+
+	return cfg
+}
+
+// parseNetworks parses a comma separated list of IP addresses and CIDR ranges.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		// Plain addresses are single host ranges
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
 	}
+
+	return networks, nil
+}
+
+// Trusted checks if an IP address belongs to a trusted proxy.
+func (cfg *Config) Trusted(ip net.IP) bool {
+	for _, network := range cfg.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Limits holds the limits and timeouts applied to a client connection.
+type Limits struct {
+	MaxMessageSize int64           // Maximum message size (bytes) allowed from client
+	MessageSizes   map[uint8]int64 // Maximum message size (bytes) by message type
+	OutboundBuffer int             // Size of the client outbound message queue
+	WriteWait      time.Duration   // Time allowed to write a message to the client
+	PongWait       time.Duration   // Time allowed to read the next pong message from the client
+	PingPeriod     time.Duration   // Send pings to client with this period (must be less than PongWait)
+	MessageRate    float64         // Messages per second allowed from client (zero is unlimited)
+	MessageBurst   int             // Messages allowed from client in a burst
+	ByteRate       float64         // Bytes per second allowed from client (zero is unlimited)
+	ByteBurst      int             // Bytes allowed from client in a burst
+	MaxRecipients  int             // Maximum recipients per message (zero is unlimited)
+	MaxRooms       int             // Maximum rooms joined per client (zero is unlimited)
+	MaxWatching    int             // Maximum presence subscriptions per client (zero is unlimited)
+}
+
+// LimitsOverride holds limits that replace the defaults for a user role.
+// Zero values keep the default.
+type LimitsOverride struct {
+	MaxMessageSize int64           `json:"max_message_size"`
+	MessageSizes   map[uint8]int64 `json:"message_sizes"`
+	OutboundBuffer int             `json:"outbound_buffer"`
+	WriteWait      Duration        `json:"write_wait"`
+	PongWait       Duration        `json:"pong_wait"`
+	PingPeriod     Duration        `json:"ping_period"`
+	MessageRate    float64         `json:"message_rate"`
+	MessageBurst   int             `json:"message_burst"`
+	ByteRate       float64         `json:"byte_rate"`
+	ByteBurst      int             `json:"byte_burst"`
+	MaxRecipients  int             `json:"max_recipients"`
+	MaxRooms       int             `json:"max_rooms"`
+	MaxWatching    int             `json:"max_watching"`
+}
+
+// Duration is a time.Duration that is read from JSON as a duration string.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "10s".
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// LimitsFor returns the connection limits for a user role.
+func (c *Config) LimitsFor(role string) Limits {
+	c.limitsMu.RLock()
+	defer c.limitsMu.RUnlock()
+
+	l := c.Limits
+
+	if o, ok := c.RoleLimits[role]; ok {
+		l = l.override(o)
+	}
+
+	// Pings must be sent before the pong wait elapses
+	if l.PingPeriod <= 0 || l.PingPeriod >= l.PongWait {
+		l.PingPeriod = (l.PongWait * 9) / 10
+	}
+
+	return l
+}
+
+// UpdateLimits applies JSON encoded limit overrides (in the ROLE_LIMITS format)
+// to a user role, or to the default limits if role is empty. Only connections
+// made after the update are affected.
+func (c *Config) UpdateLimits(role string, data []byte) error {
+	var o LimitsOverride
+
+	if err := json.Unmarshal(data, &o); err != nil {
+		return err
+	}
+
+	c.limitsMu.Lock()
+	defer c.limitsMu.Unlock()
+
+	if role == "" {
+		c.Limits = c.Limits.override(o)
+		return nil
+	}
+
+	roles := make(map[string]LimitsOverride, len(c.RoleLimits)+1)
+
+	for r, override := range c.RoleLimits {
+		roles[r] = override
+	}
+
+	roles[role] = o
+	c.RoleLimits = roles
+
+	return nil
+}
+
+// override returns a copy of the limits with overrides applied.
+func (l Limits) override(o LimitsOverride) Limits {
+	if o.MaxMessageSize > 0 {
+		l.MaxMessageSize = o.MaxMessageSize
+	}
+
+	if len(o.MessageSizes) > 0 {
+		sizes := make(map[uint8]int64, len(l.MessageSizes)+len(o.MessageSizes))
+
+		for t, size := range l.MessageSizes {
+			sizes[t] = size
+		}
+
+		for t, size := range o.MessageSizes {
+			sizes[t] = size
+		}
+
+		l.MessageSizes = sizes
+	}
+
+	if o.OutboundBuffer > 0 {
+		l.OutboundBuffer = o.OutboundBuffer
+	}
+
+	if o.WriteWait > 0 {
+		l.WriteWait = time.Duration(o.WriteWait)
+	}
+
+	if o.PongWait > 0 {
+		l.PongWait = time.Duration(o.PongWait)
+	}
+
+	if o.PingPeriod > 0 {
+		l.PingPeriod = time.Duration(o.PingPeriod)
+	}
+
+	if o.MessageRate > 0 {
+		l.MessageRate = o.MessageRate
+	}
+
+	if o.MessageBurst > 0 {
+		l.MessageBurst = o.MessageBurst
+	}
+
+	if o.ByteRate > 0 {
+		l.ByteRate = o.ByteRate
+	}
+
+	if o.ByteBurst > 0 {
+		l.ByteBurst = o.ByteBurst
+	}
+
+	if o.MaxRecipients > 0 {
+		l.MaxRecipients = o.MaxRecipients
+	}
+
+	if o.MaxRooms > 0 {
+		l.MaxRooms = o.MaxRooms
+	}
+
+	if o.MaxWatching > 0 {
+		l.MaxWatching = o.MaxWatching
+	}
+
+	return l
+}
+
+// MaxSize returns the maximum message size (bytes) allowed from client
+// for a message type. A per-type size overrides the default size, and may
+// be larger or smaller than it.
+func (l Limits) MaxSize(t uint8) int64 {
+	if size, ok := l.MessageSizes[t]; ok {
+		return size
+	}
+
+	return l.MaxMessageSize
+}
+
+// ReadLimit returns the maximum frame size (bytes) read from client,
+// which is the largest size allowed for any message type.
+func (l Limits) ReadLimit() int64 {
+	limit := l.MaxMessageSize
+
+	for _, size := range l.MessageSizes {
+		if size > limit {
+			limit = size
+		}
+	}
+
+	return limit
+}
+
+// parseJSON decodes a JSON config value, ignoring empty values.
+func parseJSON(value string, v interface{}) error {
+	if value == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(value), v)
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsMaxSize(t *testing.T) {
+	l := Limits{
+		MaxMessageSize: 512,
+		MessageSizes:   map[uint8]int64{1: 4096, 2: 64},
+	}
+
+	tests := []struct {
+		name string
+		t    uint8
+		want int64
+	}{
+		{name: "larger type size", t: 1, want: 4096},
+		{name: "smaller type size", t: 2, want: 64},
+		{name: "default size", t: 3, want: 512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.MaxSize(tt.t); got != tt.want {
+				t.Errorf("MaxSize(%d) = %d, want %d", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitsReadLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes map[uint8]int64
+		want  int64
+	}{
+		{name: "no type sizes", sizes: nil, want: 512},
+		{name: "smaller type sizes", sizes: map[uint8]int64{1: 64, 2: 128}, want: 512},
+		{name: "larger type size", sizes: map[uint8]int64{1: 64, 2: 4096}, want: 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := Limits{MaxMessageSize: 512, MessageSizes: tt.sizes}
+
+			if got := l.ReadLimit(); got != tt.want {
+				t.Errorf("ReadLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitsFor(t *testing.T) {
+	c := &Config{
+		Limits: Limits{
+			MaxMessageSize: 512,
+			MessageSizes:   map[uint8]int64{1: 1024},
+			PongWait:       60 * time.Second,
+			PingPeriod:     54 * time.Second,
+			MessageRate:    10,
+			MaxRooms:       100,
+		},
+		RoleLimits: map[string]LimitsOverride{
+			"bot":   {MessageRate: 100, MessageSizes: map[uint8]int64{2: 64}},
+			"slow":  {PongWait: Duration(10 * time.Second)},
+			"pings": {PingPeriod: Duration(20 * time.Second)},
+		},
+	}
+
+	tests := []struct {
+		role       string
+		rate       float64
+		pongWait   time.Duration
+		pingPeriod time.Duration
+		sizes      map[uint8]int64
+	}{
+		{role: "", rate: 10, pongWait: 60 * time.Second, pingPeriod: 54 * time.Second, sizes: map[uint8]int64{1: 1024}},
+		{role: "unknown", rate: 10, pongWait: 60 * time.Second, pingPeriod: 54 * time.Second, sizes: map[uint8]int64{1: 1024}},
+		{role: "bot", rate: 100, pongWait: 60 * time.Second, pingPeriod: 54 * time.Second, sizes: map[uint8]int64{1: 1024, 2: 64}},
+		{role: "slow", rate: 10, pongWait: 10 * time.Second, pingPeriod: 9 * time.Second, sizes: map[uint8]int64{1: 1024}},
+		{role: "pings", rate: 10, pongWait: 60 * time.Second, pingPeriod: 20 * time.Second, sizes: map[uint8]int64{1: 1024}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			l := c.LimitsFor(tt.role)
+
+			if l.MessageRate != tt.rate {
+				t.Errorf("message rate = %v, want %v", l.MessageRate, tt.rate)
+			}
+
+			if l.PongWait != tt.pongWait || l.PingPeriod != tt.pingPeriod {
+				t.Errorf("pong wait = %v, ping period = %v, want %v, %v", l.PongWait, l.PingPeriod, tt.pongWait, tt.pingPeriod)
+			}
+
+			if l.MaxMessageSize != 512 || l.MaxRooms != 100 {
+				t.Errorf("defaults not kept: max message size = %d, max rooms = %d", l.MaxMessageSize, l.MaxRooms)
+			}
+
+			if len(l.MessageSizes) != len(tt.sizes) {
+				t.Fatalf("message sizes = %v, want %v", l.MessageSizes, tt.sizes)
+			}
+
+			for typ, size := range tt.sizes {
+				if l.MessageSizes[typ] != size {
+					t.Errorf("message sizes = %v, want %v", l.MessageSizes, tt.sizes)
+				}
+			}
+		})
+	}
+
+	// Overrides must not change the default limits
+	if len(c.Limits.MessageSizes) != 1 {
+		t.Errorf("default message sizes changed to %v", c.Limits.MessageSizes)
+	}
+}
+
+func TestUpdateLimits(t *testing.T) {
+	c := &Config{Limits: Limits{MaxMessageSize: 512, PongWait: 60 * time.Second}}
+
+	if err := c.UpdateLimits("bot", []byte(`{"max_rooms": 5, "pong_wait": "20s"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.UpdateLimits("", []byte(`{"max_message_size": 1024}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.UpdateLimits("bot", []byte(`{"pong_wait": 20}`)); err == nil {
+		t.Error("expected an error for a duration that is not a string")
+	}
+
+	l := c.LimitsFor("bot")
+
+	if l.MaxRooms != 5 || l.PongWait != 20*time.Second || l.PingPeriod != 18*time.Second || l.MaxMessageSize != 1024 {
+		t.Errorf("limits = %+v", l)
+	}
+}
@@ -3,53 +3,152 @@ package node
 import (
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
+	"github.com/makeshiftsoftware/vsnet/pkg/auth"
 	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
 )
 
 const (
-	readBufferSize   = 1024                // Size (bytes) of the read buffer
-	writeBufferSize  = 1024                // Size (bytes) of the write buffer
-	maxMessageSize   = 512                 // Maximum message size (bytes) allowed from client
-	writeWait        = 10 * time.Second    // Time allowed to write a message to the client
-	pongWait         = 60 * time.Second    // Time allowed to read the next pong message from the client
-	pingPeriod       = (pongWait * 9) / 10 // Send pings to client with this period (must be less than pongWait)
-	closeGracePeriod = 10 * time.Second    // Time to wait before force close a connection
+	batchSubprotocol = "vsnet.batch" // Subprotocol negotiated by clients that accept batched frames
+	errorReplyPeriod = time.Second   // Minimum time between error replies to messages rejected by rate limits
 )
 
-// upgrader is the websocket connection request upgrader.
-var upgrader = &websocket.Upgrader{
-	ReadBufferSize:  readBufferSize,
-	WriteBufferSize: writeBufferSize,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+// newUpgrader creates the websocket connection request upgrader.
+func newUpgrader(cfg *config.Config) *websocket.Upgrader {
+	u := &websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		EnableCompression: cfg.Compression,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+	}
+
+	// Batching is only offered when a batch size limit is configured
+	if cfg.BatchMaxSize > 0 {
+		u.Subprotocols = []string{batchSubprotocol}
+	}
+
+	return u
+}
+
+// frame is an outbound message queued for delivery to a client. The same
+// frame is shared by every local recipient of a message. Resumable sessions
+// get a copy of the frame carrying their sequence number, which is stamped
+// on the message by the session writer.
+type frame struct {
+	typ  MessageType                // Message type, for metrics
+	data []byte                     // Encoded outbound message, without sequence number
+	pm   *websocket.PreparedMessage // Message framed once for all recipients
+	seq  uint64                     // Session sequence number, zero if the frame is not sequenced
+}
+
+// newFrame creates a new outbound frame from encoded message bytes of a message type.
+func newFrame(t MessageType, data []byte) (*frame, error) {
+	pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &frame{typ: t, data: data, pm: pm}, nil
+}
+
+// sequenced gets a copy of the frame with a session sequence number.
+func (f *frame) sequenced(seq uint64) *frame {
+	return &frame{typ: f.typ, data: f.data, pm: f.pm, seq: seq}
+}
+
+// bytes gets the encoded message of the frame, with its sequence number if any.
+func (f *frame) bytes() ([]byte, error) {
+	if f.seq == 0 {
+		return f.data, nil
+	}
+
+	return StampSeq(f.data, f.seq)
 }
 
 // client implementation
 type client struct {
-	sess      string          // Unique session ID
-	id        string          // Unique client ID
-	hub       *hub            // Node hub
-	sock      *websocket.Conn // Underlying socket connection
-	outboundc chan []byte     // Client outbound message channel
+	sess      string              // Unique session ID
+	id        string              // Unique client ID
+	role      string              // Client role
+	key       *auth.AccessKey     // Access key the client authenticated with
+	info      *sessionInfo        // Session metadata
+	hub       *hub                // Node hub
+	sock      *websocket.Conn     // Underlying socket connection
+	limits    config.Limits       // Connection limits and timeouts
+	batch     int                 // Max batch frame size (bytes), zero if client does not batch
+	resumable bool                // Session can be resumed after reconnecting
+	resume    *resumption         // Session the client resumed, nil for new sessions
+	token     string              // Resume token issued to the client
+	seq       uint64              // Last sequence number sent on the session
+	rooms     map[string]struct{} // Joined rooms
+	watching  map[string]struct{} // Client ids whose presence the client is subscribed to
+	limiter   *limiter            // Inbound rate limits, used by the read goroutine only
+	replied   time.Time           // Time of the last rate limit error reply, used by the read goroutine only
+	carry     *frame              // Frame that did not fit the last batch, used by the write goroutine only
+	pending   []*frame            // Frames written before any queued frame, prepared before the client is registered
+	outboundc chan *frame         // Client outbound message channel
+}
+
+// handshake holds the options a client connected with.
+type handshake struct {
+	resumable bool        // Client asked for a resumable session
+	resume    *resumption // Session the client asked to resume, nil for a new session
+	device    string      // Client device type
+	addr      string      // Client IP address
+	agent     string      // Client user agent
+	version   string      // Client protocol version
+}
+
+// resumption describes a session a client asked to resume.
+type resumption struct {
+	sess  string // Session ID to resume
+	token string // Resume token presented by the client, consumed once the client is admitted
+	last  uint64 // Last sequence number received by the client
 }
 
-// newClient creates a new client.
-func newClient(id string, hub *hub, sock *websocket.Conn) *client {
-	return &client{
+// inbound is a message received from a client.
+type inbound struct {
+	client *client  // Client that sent the message
+	msg    *Message // Received message
+	err    error    // Reason the message was rejected, nil if accepted
+}
+
+// newClient creates a new client for an authenticated user.
+func newClient(key *auth.AccessKey, hub *hub, sock *websocket.Conn) *client {
+	limits := hub.cfg.LimitsFor(key.Role)
+
+	c := &client{
 		sess:      uuid.NewV4().String(),
-		id:        id,
+		id:        key.ID,
+		role:      key.Role,
+		key:       key,
 		hub:       hub,
 		sock:      sock,
-		outboundc: make(chan []byte, 256),
+		limits:    limits,
+		rooms:     make(map[string]struct{}),
+		watching:  make(map[string]struct{}),
+		limiter:   newLimiter(limits, hub.users),
+		outboundc: make(chan *frame, limits.OutboundBuffer),
 	}
+
+	// Client requested batched frames during the handshake
+	if sock.Subprotocol() == batchSubprotocol {
+		c.batch = hub.cfg.BatchMaxSize
+	}
+
+	return c
 }
 
 // process starts processes for a newly connected client.
 func (c *client) process() {
-	c.sock.SetReadLimit(maxMessageSize)
-	c.sock.SetReadDeadline(time.Now().Add(pongWait))
+	c.sock.SetReadLimit(c.limits.ReadLimit())
+	c.sock.SetReadDeadline(time.Now().Add(c.limits.PongWait))
 	c.sock.SetPongHandler(c.setReadDeadline)
 	go c.read()
 	go c.write()
@@ -76,14 +175,50 @@ func (c *client) read() {
 			return
 		}
 
+		observeReceived(msg.GetType(), len(data))
+
+		// Clients cannot send node-to-node messages
+		if _, ok := Internal[msg.GetType()]; ok {
+			log.Printf("[warn] dropping internal message from client %s (type %d)", c.id, msg.GetType())
+			continue
+		}
+
+		// Enforce the size limit of the message type
+		if int64(len(data)) > c.limits.MaxSize(uint8(msg.GetType())) {
+			log.Printf("[warn] dropping oversized message from client %s (type %d, %d bytes)", c.id, msg.GetType(), len(data))
+			continue
+		}
+
+		// Enforce rate limits, either rejecting the message or the client
+		if err := c.limiter.check(c, msg, len(data)); err != nil {
+			atomic.AddUint64(&c.hub.limited, 1)
+
+			if c.hub.cfg.RateLimit == config.RateLimitDisconnect {
+				log.Printf("[warn] rate limiting client %s (session %s): %v", c.id, c.sess, err)
+				c.close(websocket.ClosePolicyViolation, "rate limit exceeded")
+				return
+			}
+
+			// Rejected messages are dropped here, so a flooding client only
+			// gets the hub to reply with an error once per period
+			if time.Since(c.replied) < errorReplyPeriod {
+				continue
+			}
+
+			log.Printf("[warn] rate limiting client %s (session %s): %v", c.id, c.sess, err)
+			c.replied = time.Now()
+			c.hub.inboundc <- &inbound{client: c, msg: msg, err: err}
+			continue
+		}
+
 		msg.SetSender(c.id)
-		c.hub.inboundc <- msg
+		c.hub.inboundc <- &inbound{client: c, msg: msg}
 	}
 }
 
 // write writes data from the hub to a client socket.
 func (c *client) write() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.limits.PingPeriod)
 
 	defer func() {
 		ticker.Stop()
@@ -91,9 +226,35 @@ func (c *client) write() {
 		c.sock.Close()
 	}()
 
+	// Frames prepared before the client was registered go before any queued frame
+	for _, f := range c.pending {
+		c.setWriteDeadline()
+
+		if err := c.writeFrame(f); err != nil {
+			return
+		}
+
+		observeSent(f)
+	}
+
+	c.pending = nil
+
 	for {
+		// A frame held over from a full batch starts the next one
+		if c.carry != nil {
+			f := c.carry
+			c.carry = nil
+			c.setWriteDeadline()
+
+			if err := c.writeBatch(f); err != nil {
+				return
+			}
+
+			continue
+		}
+
 		select {
-		case data, ok := <-c.outboundc:
+		case f, ok := <-c.outboundc:
 			c.setWriteDeadline()
 
 			if !ok {
@@ -101,17 +262,19 @@ func (c *client) write() {
 				return
 			}
 
-			w, err := c.sock.NextWriter(websocket.BinaryMessage)
+			if c.batch > 0 {
+				if err := c.writeBatch(f); err != nil {
+					return
+				}
 
-			if err != nil {
-				return
+				continue
 			}
 
-			w.Write(data)
-
-			if err := w.Close(); err != nil {
+			if err := c.writeFrame(f); err != nil {
 				return
 			}
+
+			observeSent(f)
 		case <-ticker.C:
 			c.setWriteDeadline()
 
@@ -122,12 +285,101 @@ func (c *client) write() {
 	}
 }
 
+// writeFrame writes a single frame to the client socket.
+func (c *client) writeFrame(f *frame) error {
+	// Prepared messages are framed (and compressed) once and
+	// shared across every recipient of a fan-out.
+	if f.seq == 0 {
+		return c.sock.WritePreparedMessage(f.pm)
+	}
+
+	data, err := f.bytes()
+
+	if err != nil {
+		return err
+	}
+
+	return c.sock.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// writeBatch coalesces the given frame and any frames already queued on the
+// outbound channel into a single msgpack array frame, until the client's batch
+// size limit is reached. A frame that would take the batch past the limit is
+// held over to start the next batch, as are frames left queued.
+func (c *client) writeBatch(f *frame) error {
+	frames := []*frame{f}
+	size := len(f.data)
+
+drain:
+	for len(c.outboundc) > 0 {
+		select {
+		case next, ok := <-c.outboundc:
+			if !ok {
+				break drain
+			}
+
+			if size+len(next.data) > c.batch {
+				c.carry = next
+				break drain
+			}
+
+			frames = append(frames, next)
+			size += len(next.data)
+		default:
+			break drain
+		}
+	}
+
+	w, err := c.sock.NextWriter(websocket.BinaryMessage)
+
+	if err != nil {
+		return err
+	}
+
+	enc := msgpack.NewEncoder(w)
+
+	if err := enc.EncodeArrayLen(len(frames)); err != nil {
+		return err
+	}
+
+	// Messages are already msgpack encoded, so they are written as is
+	for _, f := range frames {
+		data, err := f.bytes()
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, f := range frames {
+		observeSent(f)
+	}
+
+	return nil
+}
+
+// close closes the client socket connection, notifying the client of the
+// reason with a close frame.
+func (c *client) close(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.sock.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.limits.WriteWait))
+	c.sock.Close()
+}
+
 // setReadDeadline sets read deadline for a client socket connection.
 func (c *client) setReadDeadline(string) error {
-	return c.sock.SetReadDeadline(time.Now().Add(pongWait))
+	return c.sock.SetReadDeadline(time.Now().Add(c.limits.PongWait))
 }
 
 // setWriteDeadline sets write deadline for a client socket connection.
 func (c *client) setWriteDeadline() error {
-	return c.sock.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.sock.SetWriteDeadline(time.Now().Add(c.limits.WriteWait))
 }
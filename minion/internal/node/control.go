@@ -0,0 +1,370 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+)
+
+const (
+	nodeDrainingKey = "draining"                     // Key used to store Node draining flag
+	closeKicked     = websocket.ClosePolicyViolation // Close code sent to clients kicked by the master
+	closeShutdown   = websocket.CloseGoingAway       // Close code sent to clients disconnected by the master
+)
+
+// ErrDraining is returned when the minion is draining and does not accept new clients.
+var ErrDraining = errors.New("minion is draining")
+
+// onMasterMessage handles control requests received from master node, replying
+// with the result of the command if the master expects a response.
+func (h *hub) onMasterMessage(data []byte) error {
+	req, err := control.RequestFromBytes(data)
+
+	if err != nil && err != control.ErrUnsupportedVersion {
+		log.Printf("[error] error decoding control request: %v", err)
+		return err
+	}
+
+	var result interface{}
+
+	// Requests of other versions are rejected but still answered
+	if err == nil {
+		log.Printf("[info] received control command %s (request %s)", req.Command, req.ID)
+		result, err = h.onCommand(req)
+	}
+
+	if err != nil {
+		log.Printf("[warn] control command %s failed (request %s): %v", req.Command, req.ID, err)
+	}
+
+	if req.ReplyTo == "" {
+		return err
+	}
+
+	if err := h.reply(req, req.NewResponse(h.id, result, err)); err != nil {
+		log.Printf("[error] error replying to control request: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// onCommand runs the command of a control request, returning its result.
+func (h *hub) onCommand(req *control.Request) (interface{}, error) {
+	payload := req.Command.Payload()
+
+	if err := req.Decode(payload); err != nil {
+		return nil, err
+	}
+
+	switch req.Command {
+	case control.KickUser:
+		return h.kickUser(payload.(*control.KickUserData)), nil
+	case control.DisconnectAll:
+		return h.disconnectAll(payload.(*control.DisconnectAllData)), nil
+	case control.Drain:
+		h.requestDrain()
+		return &control.CountData{Count: h.countSessions()}, nil
+	case control.Deliver:
+		return h.deliverLocal(payload.(*control.DeliverData))
+	case control.UpdateLimits:
+		data := payload.(*control.UpdateLimitsData)
+		return nil, h.cfg.UpdateLimits(data.Role, data.Limits)
+	case control.ReportStats:
+		return h.stats(), nil
+	case control.Broadcast:
+		return h.broadcast(payload.(*control.BroadcastData))
+	case control.Recover:
+		return h.recover(payload.(*control.RecoverData)), nil
+	}
+
+	return nil, control.ErrUnknownCommand
+}
+
+// reply pushes a control response to the master's reply queue.
+func (h *hub) reply(req *control.Request, res *control.Response) error {
+	data, err := res.GetBytes()
+
+	if err != nil {
+		return err
+	}
+
+	conn := h.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	if err := conn.Send("RPUSH", req.ReplyTo, data); err != nil {
+		return err
+	}
+
+	// Responses nobody waits for anymore are discarded
+	if err := conn.Send("EXPIRE", req.ReplyTo, control.ReplyExpires); err != nil {
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// kickUser disconnects the local sessions of a user.
+func (h *hub) kickUser(data *control.KickUserData) *control.CountData {
+	reason := data.Reason
+
+	if reason == "" {
+		reason = "kicked"
+	}
+
+	count := 0
+
+	for sess, c := range h.clients[data.User] {
+		if data.Session != "" && data.Session != sess {
+			continue
+		}
+
+		log.Printf("[info] kicking session %s of client %s", c.sess, c.id)
+		h.disconnect(c, closeKicked, reason)
+		count++
+	}
+
+	return &control.CountData{Count: count}
+}
+
+// disconnectAll disconnects every local client session.
+func (h *hub) disconnectAll(data *control.DisconnectAllData) *control.CountData {
+	reason := data.Reason
+
+	if reason == "" {
+		reason = "server shutting down"
+	}
+
+	count := 0
+
+	for _, sessions := range h.clients {
+		for _, c := range sessions {
+			h.disconnect(c, closeShutdown, reason)
+			count++
+		}
+	}
+
+	log.Printf("[info] disconnected %d sessions", count)
+
+	return &control.CountData{Count: count}
+}
+
+// drain marks the node as draining, so that it stops accepting new clients.
+func (h *hub) drain() error {
+	if !atomic.CompareAndSwapInt32(&h.draining, 0, 1) {
+		return nil
+	}
+
+	log.Print("[info] draining node, no longer accepting new clients")
+
+	return h.updateNode("HSET", nodeDrainingKey, 1)
+}
+
+// requestDrain asks the node to drain and shut down.
+func (h *hub) requestDrain() {
+	select {
+	case h.drainc <- struct{}{}:
+	default:
+	}
+}
+
+// isDraining checks if the node is draining.
+func (h *hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// deliverLocal delivers a message sent by the master to the local sessions of
+// its recipients, and stores it for its offline recipients.
+func (h *hub) deliverLocal(data *control.DeliverData) (*control.CountData, error) {
+	msg := &Message{
+		Type:      MessageType(data.Type),
+		ID:        data.ID,
+		Data:      data.Data,
+		Sender:    data.Sender,
+		Recipient: data.Users,
+	}
+
+	if msg.GetID() == "" {
+		msg.SetID()
+	}
+
+	out, err := msg.GetOutbound()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := newFrame(msg.GetType(), out)
+
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+
+	for _, id := range data.Users {
+		for sess, c := range h.clients[id] {
+			if data.Session != "" && data.Session != sess {
+				continue
+			}
+
+			if h.deliver(c, f) {
+				count++
+			}
+		}
+	}
+
+	res := &control.CountData{Count: count}
+
+	if len(data.Store) == 0 {
+		return res, nil
+	}
+
+	if !h.offline.enabled() {
+		return res, ErrOfflineDisabled
+	}
+
+	// Stored atomically, so that a failed request can be retried without duplicates
+	if err := h.offline.storeAll(data.Store, out); err != nil {
+		return res, err
+	}
+
+	res.Stored = len(data.Store)
+	return res, nil
+}
+
+// broadcast delivers a message sent by the master to every local session matching
+// the broadcast filters.
+func (h *hub) broadcast(data *control.BroadcastData) (*control.CountData, error) {
+	msg := &Message{
+		Type:   MessageType(data.Type),
+		Data:   data.Data,
+		Sender: data.Sender,
+	}
+
+	msg.SetID()
+
+	out, err := msg.GetOutbound()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := newFrame(msg.GetType(), out)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clients := h.clients
+
+	// Only look up the sessions of the targeted users
+	if len(data.Users) > 0 {
+		clients = make(map[string]map[string]*client, len(data.Users))
+
+		for _, id := range data.Users {
+			if sessions, ok := h.clients[id]; ok {
+				clients[id] = sessions
+			}
+		}
+	}
+
+	count := 0
+
+	for _, sessions := range clients {
+		for _, c := range sessions {
+			if !matches(c, data) {
+				continue
+			}
+
+			if h.deliver(c, f) {
+				count++
+			}
+		}
+	}
+
+	return &control.CountData{Count: count}, nil
+}
+
+// matches checks if a client session matches the room and claim filters of a broadcast.
+func matches(c *client, data *control.BroadcastData) bool {
+	if data.Claim != nil && !c.key.HasClaim(data.Claim.Name, data.Claim.Value) {
+		return false
+	}
+
+	if len(data.Rooms) == 0 {
+		return true
+	}
+
+	for _, room := range data.Rooms {
+		if _, ok := c.rooms[room]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recover routes messages left in the peer queue of a dead minion to the current
+// location of their recipients, storing them for recipients that are offline.
+// Room messages and messages between nodes are dropped, since room members on
+// other nodes already received them.
+func (h *hub) recover(data *control.RecoverData) *control.CountData {
+	count := 0
+
+	for _, b := range data.Messages {
+		msg, err := MessageFromBytes(b)
+
+		if err != nil {
+			log.Printf("[error] error decoding recovered message: %v", err)
+			continue
+		}
+
+		if _, ok := Internal[msg.GetType()]; ok || msg.GetRoom() != "" {
+			continue
+		}
+
+		if err := h.route(msg); err != nil {
+			log.Printf("[error] error routing recovered message: %v", err)
+			continue
+		}
+
+		count++
+	}
+
+	log.Printf("[info] recovered %d messages of minion %s", count, data.Minion)
+
+	return &control.CountData{Count: count}
+}
+
+// countSessions counts the local client sessions.
+func (h *hub) countSessions() int {
+	count := 0
+
+	for _, sessions := range h.clients {
+		count += len(sessions)
+	}
+
+	return count
+}
+
+// stats reports the node stats.
+func (h *hub) stats() *control.StatsData {
+	return &control.StatsData{
+		Connections: h.countConnections(),
+		Users:       len(h.clients),
+		Sessions:    h.countSessions(),
+		Evictions:   atomic.LoadUint64(&h.evictions),
+		Dropped:     atomic.LoadUint64(&h.dropped),
+		Limited:     atomic.LoadUint64(&h.limited),
+		Draining:    h.isDraining(),
+	}
+}
@@ -0,0 +1,264 @@
+package node
+
+import (
+	"log"
+	"math"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
+	"github.com/makeshiftsoftware/vsnet/pkg/control"
+)
+
+const (
+	drainTick  = time.Second                   // Close a batch of drained sessions with this period
+	fenceCall  = 5 * time.Second               // Time allowed to disconnect clients when fenced, in case the hub is wedged
+	closeDrain = websocket.CloseServiceRestart // Close code sent to sessions of a draining node
+)
+
+// peer is a minion node as registered in redis
+type peer struct {
+	ID          string `redis:"-"`           // Minion ID
+	IP          string `redis:"ip"`          // Minion external IP
+	Port        string `redis:"port"`        // Minion port
+	Connections int64  `redis:"connections"` // Minion connections count
+	Draining    bool   `redis:"draining"`    // Minion is draining
+	Unhealthy   bool   `redis:"unhealthy"`   // Minion failed its recent health probes
+}
+
+// Drain gracefully drains the node. The node stops accepting new clients, sends
+// connected clients a reconnect message naming a suggested minion, and closes
+// the remaining sessions gradually over the drain window. Concurrent calls wait
+// for the drain to finish.
+func (n *node) Drain() {
+	n.drainOnce.Do(func() {
+		if err := n.hub.drain(); err != nil {
+			log.Printf("[error] error marking node as draining: %v", err)
+		}
+
+		target, err := n.suggestPeer()
+
+		if err != nil {
+			log.Printf("[error] error finding a minion to suggest to drained clients: %v", err)
+		}
+
+		var count int
+
+		n.hub.call(func() {
+			count = n.hub.sendReconnect(target)
+		})
+
+		log.Printf("[info] draining %d sessions over %v", count, n.cfg.DrainWindow)
+
+		n.closeGradually()
+
+		log.Print("[info] finished draining node")
+	})
+}
+
+// fence shuts the node down after it was removed from the cluster. Its presence
+// and queues are about to be reclaimed by the master, so clients are disconnected
+// right away to reconnect to another minion rather than drained gradually.
+func (n *node) fence() {
+	log.Print("[warn] node is no longer registered in the cluster, shutting down...")
+
+	if err := n.hub.drain(); err != nil {
+		log.Printf("[error] error marking node as draining: %v", err)
+	}
+
+	disconnect := func() {
+		n.hub.disconnectAll(&control.DisconnectAllData{Reason: "server left the cluster"})
+	}
+
+	if !n.hub.callTimeout(disconnect, fenceCall) {
+		log.Print("[error] hub did not disconnect clients in time, shutting down anyway")
+	}
+
+	select {
+	case n.quitc <- syscall.SIGTERM:
+	default:
+	}
+}
+
+// awaitDrain waits for a drain requested by the master, then drains the node
+// and shuts it down.
+func (n *node) awaitDrain() {
+	select {
+	case <-n.hub.drainc:
+	case <-n.cleanupc:
+		return
+	}
+
+	n.Drain()
+
+	// Shut down the same way as on a quit signal
+	select {
+	case n.quitc <- syscall.SIGTERM:
+	default:
+	}
+}
+
+// closeGradually closes the remaining client sessions in batches spread evenly
+// over the drain window.
+func (n *node) closeGradually() {
+	deadline := time.Now().Add(n.cfg.DrainWindow)
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+
+	for {
+		ticks := math.Ceil(float64(time.Until(deadline)) / float64(drainTick))
+
+		var remaining int
+
+		n.hub.call(func() {
+			remaining = n.hub.countSessions()
+
+			if remaining == 0 {
+				return
+			}
+
+			// Close everything left on the last tick
+			batch := remaining
+
+			if ticks > 1 {
+				batch = int(math.Ceil(float64(remaining) / ticks))
+			}
+
+			remaining -= n.hub.closeSessions(batch)
+		})
+
+		if remaining == 0 {
+			return
+		}
+
+		<-ticker.C
+	}
+}
+
+// suggestPeer finds the least loaded healthy minion that is not draining, other
+// than this node. Returns nil if there is no such minion.
+func (n *node) suggestPeer() (*peer, error) {
+	keys, err := n.redis.GetKeys(nodePrefix + "*")
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := n.redis.Pool.Get()
+	defer conn.Close()
+
+	ids := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, nodePrefix)
+
+		if id == n.id {
+			continue
+		}
+
+		if err := conn.Send("HGETALL", key); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	var best *peer
+
+	for _, id := range ids {
+		values, err := redis.Values(conn.Receive())
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Minion expired since its key was listed
+		if len(values) == 0 {
+			continue
+		}
+
+		p := &peer{ID: id}
+
+		if err := redis.ScanStruct(values, p); err != nil {
+			return nil, err
+		}
+
+		if p.Draining || p.Unhealthy {
+			continue
+		}
+
+		if best == nil || p.Connections < best.Connections {
+			best = p
+		}
+	}
+
+	return best, nil
+}
+
+// sendReconnect sends every local client session a reconnect message naming
+// the suggested minion. Returns the number of sessions.
+func (h *hub) sendReconnect(target *peer) int {
+	data := &ReconnectData{}
+
+	if target != nil {
+		data.Minion = target.ID
+		data.Address = target.IP + ":" + target.Port
+	}
+
+	msg, err := NewReconnect(data)
+
+	if err != nil {
+		log.Printf("[error] error creating reconnect message: %v", err)
+		return h.countSessions()
+	}
+
+	out, err := msg.GetOutbound()
+
+	if err != nil {
+		log.Printf("[error] error encoding reconnect message: %v", err)
+		return h.countSessions()
+	}
+
+	f, err := newFrame(Reconnect, out)
+
+	if err != nil {
+		log.Printf("[error] error framing reconnect message: %v", err)
+		return h.countSessions()
+	}
+
+	count := 0
+
+	for _, sessions := range h.clients {
+		for _, c := range sessions {
+			h.deliver(c, f)
+			count++
+		}
+	}
+
+	return count
+}
+
+// closeSessions disconnects up to max local client sessions. Returns the number
+// of sessions closed.
+func (h *hub) closeSessions(max int) int {
+	count := 0
+
+	for _, sessions := range h.clients {
+		for _, c := range sessions {
+			if count == max {
+				return count
+			}
+
+			h.disconnect(c, closeDrain, "server draining")
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,107 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/pkg/history"
+	"github.com/vmihailenco/msgpack"
+)
+
+// record persists a chat message to the history of its conversations.
+func (h *hub) record(msg *Message) {
+	if h.history == nil || msg.GetType() != Chat {
+		return
+	}
+
+	entry := &history.Entry{
+		ID:        msg.GetID(),
+		Sender:    msg.GetSender(),
+		Data:      msg.GetData(),
+		Timestamp: time.Now(),
+	}
+
+	if msg.GetRoom() != "" {
+		if err := h.history.Append(history.RoomConversation(msg.GetRoom()), entry); err != nil {
+			log.Printf("[error] error recording room history: %v", err)
+		}
+
+		return
+	}
+
+	for _, id := range msg.GetRecipients() {
+		if err := h.history.Append(history.DirectConversation(msg.GetSender(), id), entry); err != nil {
+			log.Printf("[error] error recording direct history: %v", err)
+		}
+	}
+}
+
+// onHistory handles a history page request from a client. Clients may only
+// page through their own direct conversations and rooms they are members of.
+func (h *hub) onHistory(c *client, msg *Message) error {
+	if h.history == nil {
+		return nil
+	}
+
+	var query HistoryQuery
+
+	if err := msgpack.Unmarshal(msg.GetData(), &query); err != nil {
+		return err
+	}
+
+	var conversation string
+
+	switch {
+	case msg.GetRoom() != "":
+		if !h.rooms.isMember(msg.GetRoom(), c) {
+			log.Printf("[warn] client %s is not a member of room %s", c.id, msg.GetRoom())
+			return nil
+		}
+
+		conversation = history.RoomConversation(msg.GetRoom())
+	case query.With != "":
+		conversation = history.DirectConversation(c.id, query.With)
+	default:
+		return nil
+	}
+
+	before, err := history.ParseCursor(query.Before)
+
+	if err != nil {
+		log.Printf("[warn] client %s sent invalid history cursor %q", c.id, query.Before)
+		return nil
+	}
+
+	page, err := h.history.Page(conversation, before, query.Limit)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(page)
+
+	if err != nil {
+		return err
+	}
+
+	res := &Message{
+		Type: History,
+		Data: data,
+		Room: msg.GetRoom(),
+	}
+
+	out, err := res.GetOutbound()
+
+	if err != nil {
+		return err
+	}
+
+	f, err := newFrame(History, out)
+
+	if err != nil {
+		return err
+	}
+
+	h.deliver(c, f)
+	return nil
+}
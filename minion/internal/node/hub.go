@@ -3,40 +3,85 @@ package node
 import (
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/websocket"
+	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
+	"github.com/makeshiftsoftware/vsnet/pkg/auth"
+	"github.com/makeshiftsoftware/vsnet/pkg/history"
 	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+	"github.com/vmihailenco/msgpack"
 )
 
+const (
+	closeSlowConsumer = websocket.CloseTryAgainLater   // Close code sent to evicted slow consumers
+	closeTakeover     = websocket.ClosePolicyViolation // Close code sent to sessions taken over by a newer session
+)
+
+// updateNodeScript runs a hash command on a field of a node key only if the key exists.
+var updateNodeScript = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call(ARGV[1], KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
 // hub implementation
 type hub struct {
 	sync.RWMutex
-	id          string             // Node ID
-	redis       *predis.Client     // Redis client
-	presence    *presence          // Hub presence
-	transport   *transport         // Hub transport
-	clients     map[string]*client // Connected clients
-	inboundc    chan *Message      // Client inbound message channel
-	masterc     chan []byte        // Master message channel
-	peerc       chan *Message      // Peer message channel
-	registerc   chan *client       // Register channel
-	unregisterc chan *client       // Unregister channel
+	connections int64                         // Connections count, including pending upgrades (accessed atomically)
+	evictions   uint64                        // Slow consumer evictions count (accessed atomically)
+	dropped     uint64                        // Slow consumer dropped messages count (accessed atomically)
+	limited     uint64                        // Rate limited messages count (accessed atomically)
+	draining    int32                         // Node is draining, set to 1 (accessed atomically)
+	id          string                        // Node ID
+	cfg         *config.Config                // Node config
+	redis       *predis.Client                // Redis client
+	presence    *presence                     // Hub presence
+	rooms       *rooms                        // Hub rooms
+	watchers    *watchers                     // Hub presence subscriptions
+	statuses    *statuses                     // Client statuses
+	offline     *offline                      // Offline message store
+	replay      *replay                       // Session replay buffers
+	users       *userLimiter                  // Cluster-wide user rate limits, nil if disabled
+	history     history.Store                 // Conversation history store, nil if disabled
+	transport   *transport                    // Hub transport
+	clients     map[string]map[string]*client // Connected clients by client id and session id
+	inboundc    chan *inbound                 // Client inbound message channel
+	masterc     chan []byte                   // Master message channel
+	peerc       chan *Message                 // Peer message channel
+	registerc   chan *client                  // Register channel
+	unregisterc chan *client                  // Unregister channel
+	callc       chan func()                   // Hub loop call channel
+	drainc      chan struct{}                 // Drain request channel
 }
 
 // newHub creates a new hub.
-func newHub(id string, redis *predis.Client) *hub {
+func newHub(id string, cfg *config.Config, redis *predis.Client) *hub {
 	h := &hub{
 		id:          id,
+		cfg:         cfg,
 		redis:       redis,
-		clients:     make(map[string]*client),
-		inboundc:    make(chan *Message),
+		clients:     make(map[string]map[string]*client),
+		inboundc:    make(chan *inbound),
 		peerc:       make(chan *Message),
 		masterc:     make(chan []byte),
 		registerc:   make(chan *client),
 		unregisterc: make(chan *client),
+		callc:       make(chan func()),
+		drainc:      make(chan struct{}, 1),
 	}
 
 	h.presence = newPresence(h.id, h.redis)
+	h.rooms = newRooms(h.id, h.redis)
+	h.watchers = newWatchers(h.id, h.redis)
+	h.statuses = newStatuses(h.redis)
+	h.offline = newOffline(h.redis, cfg.OfflineQuota, cfg.OfflineTTL)
+	h.replay = newReplay(h.redis, cfg.ReplaySize, cfg.ReplayTTL)
+	h.users = newUserLimiter(h.redis, cfg.UserMessageRate)
 	h.transport = newTransport(h.id, h.redis, h.masterc, h.peerc)
 
 	return h
@@ -44,11 +89,21 @@ func newHub(id string, redis *predis.Client) *hub {
 
 // start starts the hub.
 func (h *hub) start() error {
+	var err error
+
+	// Open history store
+	if h.history, err = history.New(h.cfg.HistoryBackend, h.redis, h.cfg.HistoryDir, h.cfg.HistoryMax); err != nil {
+		return err
+	}
+
 	// Start transport
 	if err := h.transport.start(); err != nil {
 		return err
 	}
 
+	// Start replay buffer writer
+	h.replay.start()
+
 	// Start hub channel listeners
 	go func() {
 		for {
@@ -59,15 +114,22 @@ func (h *hub) start() error {
 			case client := <-h.unregisterc:
 				// Handle unregister client request
 				h.unregisterClient(client)
-			case msg := <-h.inboundc:
+			case in := <-h.inboundc:
 				// Handle message received from client
-				h.onClientMessage(msg)
+				if in.err != nil {
+					h.onClientError(in.client, in.msg, in.err)
+				} else {
+					h.onClientMessage(in.client, in.msg)
+				}
 			case msg := <-h.peerc:
 				// Handle message received from peer
 				h.onPeerMessage(msg)
 			case data := <-h.masterc:
 				// Handle message received from master
 				h.onMasterMessage(data)
+			case fn := <-h.callc:
+				// Handle call on the hub loop
+				fn()
 			}
 		}
 	}()
@@ -85,22 +147,174 @@ func (h *hub) stop() {
 		log.Printf("[error] error stopping transport: %v", err)
 	}
 
-	// Create list of clients ids to be terminated
-	ids := make([]string, len(h.clients))
-	i := 0
+	// Write messages still waiting for replay buffers
+	h.replay.stop()
+
+	// Create list of client sessions to be terminated
+	clients := make([]*client, 0, len(h.clients))
 
 	// Close client connections
-	for id, client := range h.clients {
-		close(client.outboundc)
-		client.sock.Close()
-		ids[i] = id
-		i++
+	for _, sessions := range h.clients {
+		for _, client := range sessions {
+			close(client.outboundc)
+			client.sock.Close()
+			clients = append(clients, client)
+		}
 	}
 
 	// Remove clients from presence
-	if err := h.presence.removeMulti(ids); err != nil {
+	counts, err := h.presence.removeMulti(clients)
+
+	if err != nil {
 		log.Printf("[error] error removing clients from presence: %v", err)
 	}
+
+	// Notify subscribers of clients that went offline
+	for i, count := range counts {
+		if count == 0 {
+			h.wentOffline(clients[i].id)
+		}
+	}
+
+	// Remove node from rooms
+	if err := h.rooms.clear(); err != nil {
+		log.Printf("[error] error removing node from rooms: %v", err)
+	}
+
+	// Remove node from presence subscriptions
+	if err := h.watchers.clear(); err != nil {
+		log.Printf("[error] error removing node from presence subscriptions: %v", err)
+	}
+
+	// Close history store
+	if h.history != nil {
+		if err := h.history.Close(); err != nil {
+			log.Printf("[error] error closing history store: %v", err)
+		}
+	}
+}
+
+// call runs a function on the hub loop and waits for it to return. Hub state
+// that is owned by the loop must only be accessed this way from other goroutines.
+func (h *hub) call(fn func()) {
+	donec := make(chan struct{})
+
+	h.callc <- func() {
+		fn()
+		close(donec)
+	}
+
+	<-donec
+}
+
+// callTimeout runs a function in the hub loop like call, giving up once a timeout
+// elapses. Returns false if the function did not complete in time, in which case
+// it may still run later.
+func (h *hub) callTimeout(fn func(), timeout time.Duration) bool {
+	donec := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.callc <- func() {
+		fn()
+		close(donec)
+	}:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-donec:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// responsive checks if the hub loop picks up a call within a timeout.
+func (h *hub) responsive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.callc <- func() {}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// refreshPresence extends the presence expiration of every connected client
+// and its sessions.
+func (h *hub) refreshPresence() error {
+	var ids []string
+	var sessions []string
+	var tokens []string
+
+	h.call(func() {
+		ids = make([]string, 0, len(h.clients))
+
+		for id, clients := range h.clients {
+			ids = append(ids, id)
+
+			for sess, c := range clients {
+				sessions = append(sessions, sess)
+
+				if c.token != "" {
+					tokens = append(tokens, c.token)
+				}
+			}
+		}
+	})
+
+	// Resume tokens of connected sessions stay valid however long the session is idle
+	if err := h.replay.refresh(tokens); err != nil {
+		log.Printf("[error] error refreshing resume tokens: %v", err)
+	}
+
+	return h.presence.refresh(ids, sessions)
+}
+
+// reserve reserves a connection slot for a client about to connect. Returns false
+// if the node is at its connection limit.
+func (h *hub) reserve() bool {
+	count := atomic.AddInt64(&h.connections, 1)
+
+	if h.cfg.MaxConnections > 0 && count > h.cfg.MaxConnections {
+		atomic.AddInt64(&h.connections, -1)
+		return false
+	}
+
+	return true
+}
+
+// release releases a connection slot.
+func (h *hub) release() {
+	atomic.AddInt64(&h.connections, -1)
+}
+
+// countConnections returns the current connections count.
+func (h *hub) countConnections() int64 {
+	return atomic.LoadInt64(&h.connections)
+}
+
+// adjustConnections adjusts the node connections count in redis.
+func (h *hub) adjustConnections(amount int32) {
+	if err := h.updateNode("HINCRBY", nodeConnectionsKey, amount); err != nil {
+		log.Printf("[error] error updating connections count: %v", err)
+	}
+}
+
+// updateNode runs a hash command on a field of the node key, only if the node is
+// still registered. Updates are skipped once the node key expired or the node
+// was evicted, so that the node is not recreated without an expiration.
+func (h *hub) updateNode(cmd string, field string, value interface{}) error {
+	conn := h.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err := updateNodeScript.Do(conn, nodePrefix+h.id, cmd, field, value)
+	return err
 }
 
 // registerClient registers a client to the hub.
@@ -108,8 +322,116 @@ func (h *hub) registerClient(c *client) {
 	h.Lock()
 	defer h.Unlock()
 
-	// Add client id to connected clients map
-	h.clients[c.id] = c
+	sessions, ok := h.clients[c.id]
+
+	if !ok {
+		sessions = make(map[string]*client)
+		h.clients[c.id] = sessions
+	}
+
+	// A session resumed on this node replaces its previous connection
+	if prev, ok := sessions[c.sess]; ok {
+		h.drop(prev, closeTakeover, "session resumed")
+	}
+
+	// Add client session to connected clients map
+	sessions[c.sess] = c
+	h.adjustConnections(1)
+	clientsConnected.Inc()
+	clientConnects.Inc()
+}
+
+// greet prepares the frames a session is sent before any live traffic, in order:
+// the welcome of a resumable session, the messages it missed while reconnecting,
+// then the messages stored while its client was offline. Must be called before the
+// client is registered. Returns the number of stored messages prepared, which are
+// removed from the store once the client is registered.
+func (h *hub) greet(c *client) int {
+	if c.resumable {
+		h.welcome(c)
+	}
+
+	if !h.offline.enabled() {
+		return 0
+	}
+
+	backlog, err := h.offline.peek(c.id)
+
+	if err != nil {
+		log.Printf("[error] error fetching offline messages: %v", err)
+		return 0
+	}
+
+	for _, data := range backlog {
+		f, err := newFrame(storedType(data), data)
+
+		if err != nil {
+			log.Printf("[error] error framing offline message: %v", err)
+			continue
+		}
+
+		c.pending = append(c.pending, h.sequence(c, f))
+	}
+
+	return len(backlog)
+}
+
+// welcome prepares the welcome of a resumable session with its resume token,
+// followed by any messages it missed since the last sequence number it received.
+func (h *hub) welcome(c *client) {
+	var missed [][]byte
+
+	if c.resume != nil {
+		var err error
+
+		if missed, c.seq, err = h.replay.since(c.sess, c.resume.last); err != nil {
+			log.Printf("[error] error fetching replay buffer: %v", err)
+		}
+	}
+
+	data, err := msgpack.Marshal(&WelcomeData{
+		Session: c.sess,
+		Token:   c.token,
+		Seq:     c.seq,
+	})
+
+	if err != nil {
+		log.Printf("[error] error encoding welcome: %v", err)
+		return
+	}
+
+	welcome := &Message{
+		Type: Welcome,
+		Data: data,
+	}
+
+	out, err := welcome.GetOutbound()
+
+	if err != nil {
+		log.Printf("[error] error encoding welcome: %v", err)
+		return
+	}
+
+	f, err := newFrame(Welcome, out)
+
+	if err != nil {
+		log.Printf("[error] error framing welcome: %v", err)
+		return
+	}
+
+	c.pending = append(c.pending, f)
+
+	// Replayed messages are already sequenced
+	for _, data := range missed {
+		f, err := newFrame(storedType(data), data)
+
+		if err != nil {
+			log.Printf("[error] error framing replayed message: %v", err)
+			continue
+		}
+
+		c.pending = append(c.pending, f)
+	}
 }
 
 // unregisterClient unregisters a client from the hub.
@@ -117,43 +439,389 @@ func (h *hub) unregisterClient(c *client) {
 	h.Lock()
 	defer h.Unlock()
 
-	// Check if client exists in hub
-	client, ok := h.clients[c.id]
+	// Remove client from its rooms and presence subscriptions
+	if err := h.rooms.leaveAll(c); err != nil {
+		log.Printf("[error] error removing client from rooms: %v", err)
+	}
+
+	if err := h.watchers.unsubscribeAll(c); err != nil {
+		log.Printf("[error] error removing client presence subscriptions: %v", err)
+	}
+
+	// Check if client session exists in hub, and was not replaced by a resumed connection
+	if cur, ok := h.clients[c.id][c.sess]; ok && cur == c {
+		h.removeClient(c)
+		h.removePresence(c)
+	}
+}
+
+// removePresence removes a client session from presence, notifying subscribers
+// if it was the last session of the client.
+func (h *hub) removePresence(c *client) {
+	count, err := h.presence.remove(c)
+
+	if err != nil {
+		log.Printf("[error] error removing client from presence: %v", err)
+		return
+	}
 
-	// Check if client's session id is the same as the client
-	// being unregistered.
-	if ok && client.sess == c.sess {
+	if count == 0 {
+		h.wentOffline(c.id)
+	}
+}
+
+// wentOffline records the last seen time of a client whose last session
+// disconnected, and notifies its subscribers.
+func (h *hub) wentOffline(id string) {
+	if err := h.statuses.touch(id); err != nil {
+		log.Printf("[error] error updating client last seen time: %v", err)
+	}
+
+	h.notifyStatus(id, false)
+}
+
+// removeClient removes a client session from the hub.
+func (h *hub) removeClient(c *client) {
+	delete(h.clients[c.id], c.sess)
+
+	if len(h.clients[c.id]) == 0 {
 		delete(h.clients, c.id)
 	}
+
+	h.release()
+	h.adjustConnections(-1)
+	clientsConnected.Dec()
+	clientDisconnects.Inc()
+}
+
+// admit checks if a user may open a new session. Under the reject takeover policy,
+// a user already at the session limit is refused before the connection is upgraded.
+// The limit is enforced again once the session is registered, see limitSessions.
+func (h *hub) admit(id string) error {
+	if h.cfg.MaxSessions <= 0 || h.cfg.SessionTakeover != config.SessionTakeoverReject {
+		return nil
+	}
+
+	sessions, _, err := h.presence.sessions(id)
+
+	if err != nil {
+		return err
+	}
+
+	if len(sessions) >= h.cfg.MaxSessions {
+		return ErrMaxSessions
+	}
+
+	return nil
+}
+
+// limitSessions enforces the session limit of a user after a new session was
+// registered. Sessions in excess are the newest ones under the reject takeover
+// policy, and the oldest ones otherwise, wherever they are connected. Concurrent
+// connects of a user agree on the sessions in excess, since sessions are ordered
+// by connect time.
+func (h *hub) limitSessions(c *client) error {
+	if h.cfg.MaxSessions <= 0 {
+		return nil
+	}
+
+	sessions, locations, err := h.presence.sessions(c.id)
+
+	if err != nil {
+		return err
+	}
+
+	excess := len(sessions) - h.cfg.MaxSessions
+
+	if excess <= 0 {
+		return nil
+	}
+
+	if h.cfg.SessionTakeover == config.SessionTakeoverReject {
+		sessions = sessions[len(sessions)-excess:]
+	} else {
+		sessions = sessions[:excess]
+	}
+
+	for _, sess := range sessions {
+		if err := h.kick(c.id, sess, locations[sess]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kick sends a kick session message to the minion node hosting a client session.
+func (h *hub) kick(id string, sess string, location string) error {
+	kick := &Message{
+		Type:      Kick,
+		Recipient: []string{id},
+		Session:   sess,
+	}
+
+	data, err := kick.GetBytes()
+
+	if err != nil {
+		return err
+	}
+
+	return h.transport.send(location, data)
+}
+
+// resumable checks if a client session can be resumed. Returns the session to
+// resume if a valid resume token was presented, or nil for a new session. The
+// token is only redeemed once the client is connected, see onClientConnected,
+// so that a client refused by this node can still resume elsewhere.
+func (h *hub) resumable(id string, token string, last uint64) (*resumption, error) {
+	if !h.replay.enabled() || token == "" {
+		return nil, nil
+	}
+
+	sess, err := h.replay.check(id, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumption{sess: sess, token: token, last: last}, nil
+}
+
+// takeOver takes a resumed session over from the node it was connected to. Waits
+// for the previous connection to be dropped and its messages to be added to the
+// replay buffer, so that the buffer is complete when read.
+func (h *hub) takeOver(id string, sess string, location string) error {
+	if err := h.replay.clearHandover(sess); err != nil {
+		return err
+	}
+
+	if location == h.id {
+		h.call(func() {
+			h.handOver(id, sess, false)
+		})
+	} else if err := h.kick(id, sess, location); err != nil {
+		return err
+	}
+
+	ok, err := h.replay.awaitHandover(sess)
+
+	if err != nil {
+		return err
+	}
+
+	// The previous node may be gone, in which case it no longer adds to the buffer
+	if !ok {
+		log.Printf("[warn] node %s did not hand off session %s in time", location, sess)
+	}
+
+	return nil
 }
 
-// onClientConnected handles a new client socket connection.
-func (h *hub) onClientConnected(sock *websocket.Conn) error {
+// handOver drops the connection of a session resumed on another connection, then
+// acknowledges the handoff once the messages of the session are in its replay buffer.
+func (h *hub) handOver(id string, sess string, remote bool) {
+	if client, ok := h.clients[id][sess]; ok {
+		if remote {
+			log.Printf("[info] session %s of client %s taken over", client.sess, client.id)
+			h.disconnect(client, closeTakeover, "session taken over")
+		} else {
+			h.drop(client, closeTakeover, "session resumed")
+		}
+	}
+
+	if h.replay.enabled() {
+		h.replay.handOver(sess)
+	}
+}
+
+// onClientConnected handles a new client socket connection. Resumable clients
+// are issued a resume token, and a resumed session is taken over from the node
+// it was previously connected to.
+func (h *hub) onClientConnected(key *auth.AccessKey, sock *websocket.Conn, hs *handshake) error {
 	// Create new client
-	c := newClient("abc", h, sock)
+	c := newClient(key, h, sock)
+	c.resumable = h.replay.enabled() && (hs.resumable || hs.resume != nil)
+	c.info = newSessionInfo(c, h.id, hs)
+
+	if hs.resume != nil {
+		// The token is redeemed once the client was admitted and upgraded
+		sess, err := h.replay.redeem(c.id, hs.resume.token)
+
+		if err != nil {
+			return err
+		}
+
+		if sess != hs.resume.sess {
+			return ErrInvalidResumeToken
+		}
+
+		c.sess = hs.resume.sess
+		c.resume = hs.resume
+		c.info.Session = c.sess
+
+		_, locations, err := h.presence.sessions(c.id)
+
+		if err != nil {
+			return err
+		}
+
+		// Drop the previous connection of the session before reading its replay buffer
+		if location, ok := locations[c.sess]; ok {
+			if err := h.takeOver(c.id, c.sess, location); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.resumable {
+		var err error
+
+		if c.token, err = h.replay.issue(c); err != nil {
+			return err
+		}
+	}
 
 	// Add client to presence
-	if err := h.presence.add(c.id); err != nil {
+	count, err := h.presence.add(c)
+
+	if err != nil {
 		return err
 	}
 
+	// Record device type and last seen time
+	if err := h.statuses.set(c.id, &StatusData{Device: hs.device}); err != nil {
+		log.Printf("[error] error updating client status: %v", err)
+	}
+
+	// Notify subscribers if this is the first session of the client
+	if count == 1 {
+		h.notifyStatus(c.id, true)
+	}
+
+	// Frames sent before any live traffic
+	stored := h.greet(c)
+
 	// Register client using channel
 	h.registerc <- c
 
 	// Start client processes
 	c.process()
+
+	// Stored messages are only removed once handed to the client writer
+	if err := h.offline.remove(c.id, stored); err != nil {
+		log.Printf("[error] error removing delivered offline messages: %v", err)
+	}
+
+	// Resuming a session does not open a new one
+	if c.resume == nil {
+		if err := h.limitSessions(c); err != nil {
+			log.Printf("[error] error enforcing session limit of client %s: %v", c.id, err)
+		}
+	}
+
 	return nil
 }
 
-// onClientMessage handles messages received from client. Routes messages received
-// to their intended recipients on remote minion nodes.
-func (h *hub) onClientMessage(msg *Message) error {
-	locations, err := h.presence.locate(msg.GetRecipients())
+// onClientError replies to a message that was rejected on receipt with an
+// error message. Client readers throttle the rate limited messages they forward.
+func (h *hub) onClientError(c *client, msg *Message, reason error) {
+	// The session may have been dropped while the message was queued
+	if cur, ok := h.clients[c.id][c.sess]; !ok || cur != c {
+		return
+	}
+
+	out, err := NewError(msg, reason).GetOutbound()
+
+	if err != nil {
+		log.Printf("[error] error encoding error message: %v", err)
+		return
+	}
+
+	f, err := newFrame(Error, out)
+
+	if err != nil {
+		log.Printf("[error] error framing error message: %v", err)
+		return
+	}
+
+	h.deliver(c, f)
+}
+
+// onClientMessage handles messages received from client. Handles room control
+// messages, and routes other messages received to their intended recipients
+// on remote minion nodes.
+func (h *hub) onClientMessage(c *client, msg *Message) error {
+	switch {
+	case msg.GetType() == Join:
+		if err := c.checkRooms(msg.GetRoom()); err != nil {
+			h.onClientError(c, msg, err)
+			return nil
+		}
+
+		return h.rooms.join(msg.GetRoom(), c)
+	case msg.GetType() == Leave:
+		return h.rooms.leave(msg.GetRoom(), c)
+	case msg.GetType() == History:
+		return h.onHistory(c, msg)
+	case msg.GetType() == Subscribe:
+		if err := c.checkWatching(msg.GetRecipients()); err != nil {
+			h.onClientError(c, msg, err)
+			return nil
+		}
+
+		return h.onSubscribe(c, msg)
+	case msg.GetType() == Unsubscribe:
+		return h.watchers.unsubscribe(c, msg.GetRecipients())
+	case msg.GetType() == Status:
+		return h.onStatus(c, msg)
+	}
+
+	// Assign message id and record sender's location for receipts
+	msg.SetID()
+	msg.SetOrigin(h.id, c.sess)
+	msg.SetSession("")
+
+	if msg.GetRoom() != "" {
+		return h.routeRoom(c, msg)
+	}
+
+	return h.routeUsers(msg)
+}
+
+// routeUsers routes a message to the minion nodes of its recipients. Messages for
+// recipients that are not connected to any node are stored for delivery on
+// reconnect.
+func (h *hub) routeUsers(msg *Message) error {
+	// Persist chat messages to conversation history
+	h.record(msg)
+
+	return h.route(msg)
+}
+
+// route sends a message to the minion nodes its recipients are connected to, and
+// stores it for recipients that are not connected to any node.
+func (h *hub) route(msg *Message) error {
+	recipients := msg.GetRecipients()
+	locations, err := h.presence.locate(recipients)
 
 	if err != nil {
 		return err
 	}
 
+	located := make(map[string]struct{}, len(recipients))
+
+	for _, members := range locations {
+		for _, id := range members {
+			located[id] = struct{}{}
+		}
+	}
+
+	for _, id := range recipients {
+		if _, ok := located[id]; !ok {
+			h.storeOffline(msg, id)
+		}
+	}
+
 	for location, members := range locations {
 		msg.SetRecipients(members)
 
@@ -169,9 +837,52 @@ func (h *hub) onClientMessage(msg *Message) error {
 	return nil
 }
 
+// routeRoom routes a message once to every minion node hosting members of its
+// room. Only members of a room may send to it. Room messages do not get delivery
+// receipts, as members are not known to the sender and one receipt per member
+// would multiply the traffic of every room message.
+func (h *hub) routeRoom(c *client, msg *Message) error {
+	if !h.rooms.isMember(msg.GetRoom(), c) {
+		log.Printf("[warn] client %s is not a member of room %s", c.id, msg.GetRoom())
+		return nil
+	}
+
+	// Persist chat messages to conversation history
+	h.record(msg)
+
+	locations, err := h.rooms.locate(msg.GetRoom())
+
+	if err != nil {
+		return err
+	}
+
+	msg.SetRecipients(nil)
+
+	data, err := msg.GetBytes()
+
+	if err != nil {
+		return err
+	}
+
+	for _, location := range locations {
+		h.transport.send(location, data)
+	}
+
+	return nil
+}
+
 // onPeerMessage handles messages received from peer nodes. Routes message to intended
-// recipients on the local minion node.
+// recipients on the local minion node, or to local members of the message room.
 func (h *hub) onPeerMessage(msg *Message) error {
+	switch msg.GetType() {
+	case Kick:
+		return h.onKick(msg)
+	case Receipt:
+		return h.onReceipt(msg)
+	case Presence:
+		return h.onPresence(msg)
+	}
+
 	// Get outbound message for delivery
 	data, err := msg.GetOutbound()
 
@@ -179,25 +890,257 @@ func (h *hub) onPeerMessage(msg *Message) error {
 		return err
 	}
 
+	// Frame the outbound message once for all local recipients
+	f, err := newFrame(msg.GetType(), data)
+
+	if err != nil {
+		return err
+	}
+
+	if msg.GetRoom() != "" {
+		origin, sess := msg.GetOrigin()
+
+		for client := range h.rooms.local(msg.GetRoom()) {
+			// The sending session does not receive its own message, other
+			// sessions of the sender do
+			if origin == h.id && client.sess == sess {
+				continue
+			}
+
+			h.deliver(client, f)
+		}
+
+		return nil
+	}
+
 	for _, id := range msg.GetRecipients() {
-		// Find client on this node
-		client, ok := h.clients[id]
+		status := Failed
 
-		if ok {
+		// Find client sessions on this node, reporting the best outcome of all sessions
+		for _, client := range h.clients[id] {
 			// Attempt message delivery
+			if s := h.deliverStatus(client, f); receiptRank[s] > receiptRank[status] {
+				status = s
+			}
+		}
+
+		if msg.GetAck() {
+			h.sendReceipt(msg, id, status)
+		}
+	}
+
+	return nil
+}
+
+// storeOffline stores a message for an offline recipient, reporting the outcome
+// to the sender if delivery receipts were requested.
+func (h *hub) storeOffline(msg *Message, id string) {
+	status := Failed
+
+	if h.offline.enabled() {
+		data, err := msg.GetOutbound()
+
+		if err == nil {
+			err = h.offline.store(id, data)
+		}
+
+		if err != nil {
+			log.Printf("[error] error storing offline message: %v", err)
+		} else {
+			status = Stored
+		}
+	}
+
+	if msg.GetAck() {
+		h.sendReceipt(msg, id, status)
+	}
+}
+
+// onReceipt handles a receipt message received from a peer node. Delivers the
+// receipt to the sender session it is addressed to.
+func (h *hub) onReceipt(msg *Message) error {
+	for _, id := range msg.GetRecipients() {
+		client, ok := h.clients[id][msg.GetSession()]
+
+		if !ok {
+			continue
+		}
+
+		data, err := msg.GetOutbound()
+
+		if err != nil {
+			return err
+		}
+
+		f, err := newFrame(msg.GetType(), data)
+
+		if err != nil {
+			return err
+		}
+
+		h.deliver(client, f)
+	}
+
+	return nil
+}
+
+// sendReceipt sends a delivery receipt for a message recipient to the minion
+// node of the message sender.
+func (h *hub) sendReceipt(msg *Message, recipient string, status ReceiptStatus) {
+	receipt, err := NewReceipt(msg, recipient, status)
+
+	if err != nil {
+		log.Printf("[error] error creating receipt: %v", err)
+		return
+	}
+
+	data, err := receipt.GetBytes()
+
+	if err != nil {
+		log.Printf("[error] error encoding receipt: %v", err)
+		return
+	}
+
+	origin, _ := msg.GetOrigin()
+
+	if err := h.transport.send(origin, data); err != nil {
+		log.Printf("[error] error sending receipt: %v", err)
+	}
+}
+
+// deliver queues an outbound frame for a local client. Returns true if the frame
+// was queued for delivery.
+func (h *hub) deliver(c *client, f *frame) bool {
+	return h.deliverStatus(c, f) == Delivered
+}
+
+// deliverStatus queues an outbound frame for a local client. Frames sent to
+// resumable sessions are sequenced and kept for replay. Returns the receipt
+// status of the frame.
+func (h *hub) deliverStatus(c *client, f *frame) ReceiptStatus {
+	if !c.resumable {
+		return h.enqueue(c, f)
+	}
+
+	status := h.enqueue(c, h.sequence(c, f))
+
+	// Frames of an evicted session are still replayed if it resumes
+	if cur, ok := h.clients[c.id][c.sess]; status == Failed && (!ok || cur != c) {
+		return Queued
+	}
+
+	return status
+}
+
+// sequence sequences an outbound frame for a resumable session and keeps it for
+// replay. Frames of other sessions are returned as is.
+func (h *hub) sequence(c *client, f *frame) *frame {
+	if !c.resumable {
+		return f
+	}
+
+	c.seq++
+	f = f.sequenced(c.seq)
+	h.replay.push(c.sess, c.token, f)
+
+	return f
+}
+
+// enqueue queues an outbound frame for a local client. If the client's outbound
+// queue is full, the configured slow consumer policy is applied. Returns
+// Delivered if the frame was queued for delivery, Stored if it was spilled to
+// the offline store and Failed otherwise.
+func (h *hub) enqueue(c *client, f *frame) ReceiptStatus {
+	select {
+	case c.outboundc <- f:
+		return Delivered
+	default:
+	}
+
+	switch h.cfg.SlowConsumer {
+	case config.SlowConsumerDropOldest:
+		// Make room by discarding the oldest queued frame
+		select {
+		case <-c.outboundc:
+		default:
+		}
+
+		atomic.AddUint64(&h.dropped, 1)
+
+		select {
+		case c.outboundc <- f:
+			return Delivered
+		default:
+		}
+	case config.SlowConsumerDropNewest:
+		atomic.AddUint64(&h.dropped, 1)
+	case config.SlowConsumerSpill:
+		// Move everything still queued, then the current frame, to the offline store
+		spilled := make([][]byte, 0, len(c.outboundc)+1)
+
+	spill:
+		for {
 			select {
-			case client.outboundc <- data:
+			case queued := <-c.outboundc:
+				spilled = append(spilled, queued.data)
 			default:
-				close(client.outboundc)
-				delete(h.clients, client.id)
+				break spill
 			}
 		}
+
+		spilled = append(spilled, f.data)
+		status := Failed
+
+		if !h.offline.enabled() {
+			log.Printf("[warn] cannot spill messages of client %s, offline store is disabled", c.id)
+		} else if err := h.offline.store(c.id, spilled...); err != nil {
+			log.Printf("[error] error spilling messages to offline store: %v", err)
+		} else {
+			status = Stored
+		}
+
+		h.evict(c, len(spilled))
+		return status
+	default:
+		h.evict(c, len(c.outboundc))
 	}
 
-	return nil
+	return Failed
 }
 
-// onMasterMessage handles messages received from master node.
-func (h *hub) onMasterMessage(data []byte) error {
+// onKick handles a kick session message received from a peer node, handing the
+// session off to its new connection.
+func (h *hub) onKick(msg *Message) error {
+	for _, id := range msg.GetRecipients() {
+		h.handOver(id, msg.GetSession(), true)
+	}
+
 	return nil
 }
+
+// evict disconnects a slow consumer and removes it from the hub and presence.
+func (h *hub) evict(c *client, depth int) {
+	atomic.AddUint64(&h.evictions, 1)
+
+	log.Printf("[warn] evicting slow consumer client %s (session %s, queue depth %d)", c.id, c.sess, depth)
+
+	h.disconnect(c, closeSlowConsumer, "slow consumer")
+}
+
+// disconnect removes a client session from the hub, its rooms and presence,
+// and closes its socket connection with a close code.
+func (h *hub) disconnect(c *client, code int, reason string) {
+	h.drop(c, code, reason)
+	h.removePresence(c)
+}
+
+// drop removes a client session from the hub and its rooms, and closes its
+// socket connection with a close code.
+func (h *hub) drop(c *client, code int, reason string) {
+	close(c.outboundc)
+	h.removeClient(c)
+	h.rooms.leaveAll(c)
+	h.watchers.unsubscribeAll(c)
+
+	go c.close(code, reason)
+}
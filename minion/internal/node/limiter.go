@@ -0,0 +1,242 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+)
+
+const (
+	rateLimitPrefix = "ratelimit:" // Prefix for cluster-wide rate limit counters in redis
+)
+
+// Rate limit errors
+var (
+	ErrMessageRate   = errors.New("message rate limit exceeded")
+	ErrByteRate      = errors.New("byte rate limit exceeded")
+	ErrRecipients    = errors.New("too many recipients")
+	ErrUserRateLimit = errors.New("user rate limit exceeded")
+	ErrRooms         = errors.New("too many rooms joined")
+	ErrWatching      = errors.New("too many presence subscriptions")
+)
+
+// Error codes sent to clients in error messages
+const (
+	ErrorRateLimited       = "rate_limited"
+	ErrorTooManyRecipients = "too_many_recipients"
+	ErrorTooManyRooms      = "too_many_rooms"
+	ErrorTooManyWatching   = "too_many_subscriptions"
+	ErrorInternal          = "internal"
+)
+
+// ErrorCode gets the error code sent to clients for a rejected message.
+func ErrorCode(err error) string {
+	switch err {
+	case ErrMessageRate, ErrByteRate, ErrUserRateLimit:
+		return ErrorRateLimited
+	case ErrRecipients:
+		return ErrorTooManyRecipients
+	case ErrRooms:
+		return ErrorTooManyRooms
+	case ErrWatching:
+		return ErrorTooManyWatching
+	}
+
+	return ErrorInternal
+}
+
+// bucket implements a token bucket rate limiter. A nil bucket allows everything.
+type bucket struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Maximum tokens
+	tokens float64   // Available tokens
+	last   time.Time // Time tokens were last added
+}
+
+// newBucket creates a new token bucket. Returns nil if the rate is unlimited.
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+
+	if b < rate {
+		b = rate
+	}
+
+	return &bucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// allow takes n tokens from the bucket if available.
+func (b *bucket) allow(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// limiter implements the rate limits of a client connection. It is only used
+// by the client read goroutine.
+type limiter struct {
+	messages      *bucket      // Messages per second
+	bytes         *bucket      // Bytes per second
+	maxRecipients int          // Maximum recipients per message
+	users         *userLimiter // Cluster-wide limits per user
+}
+
+// newLimiter creates the rate limiter of a client connection.
+func newLimiter(limits config.Limits, users *userLimiter) *limiter {
+	return &limiter{
+		messages:      newBucket(limits.MessageRate, limits.MessageBurst),
+		bytes:         newBucket(limits.ByteRate, limits.ByteBurst),
+		maxRecipients: limits.MaxRecipients,
+		users:         users,
+	}
+}
+
+// check checks if a message of a client is within its rate limits.
+func (l *limiter) check(c *client, msg *Message, size int) error {
+	if !l.messages.allow(1) {
+		return ErrMessageRate
+	}
+
+	if !l.bytes.allow(float64(size)) {
+		return ErrByteRate
+	}
+
+	if l.maxRecipients > 0 && len(msg.GetRecipients()) > l.maxRecipients {
+		return ErrRecipients
+	}
+
+	ok, err := l.users.allow(c.id)
+
+	// Cluster-wide limits are not enforced while redis is unavailable
+	if err != nil {
+		log.Printf("[error] error checking user rate limit: %v", err)
+		return nil
+	}
+
+	if !ok {
+		return ErrUserRateLimit
+	}
+
+	return nil
+}
+
+// checkRooms checks if a client may join a room within its room limit.
+// Used by the hub only.
+func (c *client) checkRooms(room string) error {
+	if _, ok := c.rooms[room]; ok || c.limits.MaxRooms <= 0 {
+		return nil
+	}
+
+	if len(c.rooms) >= c.limits.MaxRooms {
+		return ErrRooms
+	}
+
+	return nil
+}
+
+// checkWatching checks if a client may subscribe to the presence of clients by
+// their ids within its subscription limit. Used by the hub only.
+func (c *client) checkWatching(ids []string) error {
+	if c.limits.MaxWatching <= 0 {
+		return nil
+	}
+
+	added := make(map[string]struct{}, len(ids))
+
+	for _, id := range ids {
+		if _, ok := c.watching[id]; !ok {
+			added[id] = struct{}{}
+		}
+	}
+
+	if len(c.watching)+len(added) > c.limits.MaxWatching {
+		return ErrWatching
+	}
+
+	return nil
+}
+
+// userLimiter implements cluster-wide per user message rate limits, counted in
+// redis over one second windows. A nil user limiter allows everything.
+type userLimiter struct {
+	redis *predis.Client // Redis client
+	rate  int            // Messages per second allowed per user
+}
+
+// newUserLimiter creates a new user limiter. Returns nil if the rate is unlimited.
+func newUserLimiter(redis *predis.Client, rate int) *userLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &userLimiter{
+		redis: redis,
+		rate:  rate,
+	}
+}
+
+// allow counts a message of a user. Returns true if it is within the user's rate limit.
+func (u *userLimiter) allow(id string) (bool, error) {
+	if u == nil {
+		return true, nil
+	}
+
+	key := rateLimitPrefix + id + ":" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	conn := u.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+
+	if err := conn.Send("INCR", key); err != nil {
+		return false, err
+	}
+
+	if err := conn.Send("EXPIRE", key, 2); err != nil {
+		return false, err
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := redis.Int(result[0], nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	return count <= u.rate, nil
+}
@@ -0,0 +1,77 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBucket(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		want  float64
+	}{
+		{name: "burst above rate", rate: 2, burst: 10, want: 10},
+		{name: "burst below rate", rate: 5, burst: 1, want: 5},
+		{name: "no burst", rate: 3, burst: 0, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBucket(tt.rate, tt.burst)
+
+			if b.burst != tt.want || b.tokens != tt.want {
+				t.Errorf("burst = %v, tokens = %v, want %v", b.burst, b.tokens, tt.want)
+			}
+		})
+	}
+
+	if newBucket(0, 10) != nil || newBucket(-1, 10) != nil {
+		t.Error("bucket without a rate must be nil")
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		n       float64
+		want    bool
+		left    float64
+	}{
+		{name: "available", tokens: 5, elapsed: 0, n: 1, want: true, left: 4},
+		{name: "all tokens", tokens: 5, elapsed: 0, n: 5, want: true, left: 0},
+		{name: "not enough", tokens: 2, elapsed: 0, n: 3, want: false, left: 2},
+		{name: "empty", tokens: 0, elapsed: 0, n: 1, want: false, left: 0},
+		{name: "refilled", tokens: 0, elapsed: 500 * time.Millisecond, n: 1, want: true, left: 4},
+		{name: "refill capped at burst", tokens: 9, elapsed: time.Minute, n: 2, want: true, left: 8},
+		{name: "partially refilled", tokens: 0, elapsed: 100 * time.Millisecond, n: 2, want: false, left: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBucket(10, 10)
+			b.tokens = tt.tokens
+			b.last = time.Now().Add(-tt.elapsed)
+
+			if got := b.allow(tt.n); got != tt.want {
+				t.Errorf("allow(%v) = %v, want %v", tt.n, got, tt.want)
+			}
+
+			// Allow for the time elapsed while the test runs
+			if b.tokens < tt.left || b.tokens > tt.left+0.1 {
+				t.Errorf("tokens left = %v, want %v", b.tokens, tt.left)
+			}
+		})
+	}
+}
+
+func TestBucketAllowNil(t *testing.T) {
+	var b *bucket
+
+	if !b.allow(1e9) {
+		t.Error("nil bucket must allow everything")
+	}
+}
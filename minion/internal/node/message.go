@@ -1,8 +1,12 @@
 package node
 
 import (
+	"encoding/binary"
+	"errors"
+	"math"
 	"time"
 
+	uuid "github.com/satori/go.uuid"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -13,13 +17,79 @@ type MessageType uint8
 const (
 	// Chat message type
 	Chat MessageType = iota
+	// Join room control message type
+	Join
+	// Leave room control message type
+	Leave
+	// Kick session message type, sent between nodes only
+	Kick
+	// Receipt message type
+	Receipt
+	// History page request and response message type
+	History
+	// Welcome message type, sent to resumable sessions on connect
+	Welcome
+	// Subscribe to presence control message type
+	Subscribe
+	// Unsubscribe from presence control message type
+	Unsubscribe
+	// Presence events message type
+	Presence
+	// Status update control message type
+	Status
+	// Error message type, sent to clients when a message is rejected
+	Error
+	// Reconnect message type, sent to clients of a draining node
+	Reconnect
 )
 
+// Client statuses
+const (
+	StatusOnline    = "online"    // Client is online
+	StatusAway      = "away"      // Client is away
+	StatusBusy      = "busy"      // Client is busy
+	StatusInvisible = "invisible" // Client is online but appears offline to others
+)
+
+// ReceiptStatus type
+type ReceiptStatus uint8
+
+// ReceiptStatus enum
+const (
+	// Delivered status, the message was queued for delivery to the recipient
+	Delivered ReceiptStatus = iota
+	// Failed status, the message could not be delivered to the recipient
+	Failed
+	// Stored status, the recipient is offline and the message was stored for later delivery
+	Stored
+	// Queued status, the recipient session was disconnected and the message was kept
+	// for replay when the session resumes
+	Queued
+)
+
+// receiptRank orders receipt statuses from the worst to the best outcome
+var receiptRank = map[ReceiptStatus]int{
+	Failed:    0,
+	Queued:    1,
+	Stored:    2,
+	Delivered: 3,
+}
+
 // TimestampRequired denotes message types that require a timestamp
 var TimestampRequired = map[MessageType]struct{}{
 	(Chat): struct{}{},
 }
 
+// Internal denotes message types that clients are not allowed to send
+var Internal = map[MessageType]struct{}{
+	(Kick):      struct{}{},
+	(Receipt):   struct{}{},
+	(Welcome):   struct{}{},
+	(Presence):  struct{}{},
+	(Error):     struct{}{},
+	(Reconnect): struct{}{},
+}
+
 // IMessage interface
 type IMessage interface {
 	GetBytes() []byte
@@ -32,17 +102,154 @@ type IMessage interface {
 	SetSender(id string)
 	GetRecipients() []string
 	SetRecipients(ids []string)
+	GetRoom() string
+	SetRoom(id string)
 	GetTimestamp() time.Time
 	SetTimestamp()
+	GetID() string
+	SetID()
+	GetRef() string
+	GetAck() bool
+	GetOrigin() (string, string)
+	SetOrigin(id string, sess string)
+	GetSession() string
+	SetSession(sess string)
+	GetSeq() uint64
+	SetSeq(seq uint64)
 }
 
 // Message implementation
 type Message struct {
-	Type      MessageType `msgpack:"t,omitempty"`  // Message type
-	Data      []byte      `msgpack:"d,omitempty"`  // Message data
-	Sender    string      `msgpack:"s,omitempty"`  // Message sender
-	Recipient []string    `msgpack:"r,omitempty"`  // Message recipients
-	Timestamp time.Time   `msgpack:"ts,omitempty"` // Message timestamp
+	Type          MessageType `msgpack:"t,omitempty"`   // Message type
+	ID            string      `msgpack:"id,omitempty"`  // Message ID (server assigned)
+	Ref           string      `msgpack:"ref,omitempty"` // Message reference (client assigned, echoed in receipts)
+	Ack           bool        `msgpack:"a,omitempty"`   // Message delivery receipts requested, ignored for room messages
+	Data          []byte      `msgpack:"d,omitempty"`   // Message data
+	Sender        string      `msgpack:"s,omitempty"`   // Message sender
+	Recipient     []string    `msgpack:"r,omitempty"`   // Message recipients
+	Room          string      `msgpack:"rm,omitempty"`  // Message room
+	Timestamp     time.Time   `msgpack:"ts,omitempty"`  // Message timestamp
+	Origin        string      `msgpack:"o,omitempty"`   // Sender's minion ID (internal)
+	OriginSession string      `msgpack:"os,omitempty"`  // Sender's session ID (internal)
+	Session       string      `msgpack:"ss,omitempty"`  // Target session ID (internal)
+	Seq           uint64      `msgpack:"q,omitempty"`   // Session sequence number (resumable sessions only, see StampSeq)
+}
+
+// PresenceEvent is a change in the presence of a client. The data of a presence
+// message is a list of presence events.
+type PresenceEvent struct {
+	User     string `msgpack:"u"`            // Client ID
+	Online   bool   `msgpack:"on,omitempty"` // Client has at least one connected session
+	Status   string `msgpack:"st,omitempty"` // Client status
+	Text     string `msgpack:"tx,omitempty"` // Client custom status text
+	Device   string `msgpack:"dv,omitempty"` // Client device type
+	LastSeen int64  `msgpack:"ls,omitempty"` // Client last seen time (unix milliseconds)
+}
+
+// Visible gets the presence event as seen by other clients. Invisible clients
+// appear offline.
+func (e PresenceEvent) Visible() PresenceEvent {
+	if e.Status != StatusInvisible {
+		return e
+	}
+
+	return PresenceEvent{User: e.User, LastSeen: e.LastSeen}
+}
+
+// StatusData is the data of a status update message
+type StatusData struct {
+	Status string  `msgpack:"st,omitempty"` // Client status
+	Text   *string `msgpack:"tx,omitempty"` // Client custom status text, an empty text clears it
+	Device string  `msgpack:"dv,omitempty"` // Client device type
+}
+
+// WelcomeData is the data of a welcome message
+type WelcomeData struct {
+	Session string `msgpack:"ss"`          // Session ID
+	Token   string `msgpack:"tk"`          // Token to resume the session with after reconnecting
+	Seq     uint64 `msgpack:"q,omitempty"` // Last sequence number sent on the session
+}
+
+// ReceiptData is the data of a receipt message
+type ReceiptData struct {
+	ID        string        `msgpack:"id"`            // ID of the message the receipt is for
+	Ref       string        `msgpack:"ref,omitempty"` // Reference of the message the receipt is for
+	Recipient string        `msgpack:"r"`             // Recipient of the message
+	Status    ReceiptStatus `msgpack:"st"`            // Delivery status
+}
+
+// ReconnectData is the data of a reconnect message. Clients should reconnect to
+// the suggested minion, or through the load balancer if none is suggested.
+type ReconnectData struct {
+	Minion  string `msgpack:"m,omitempty"`  // Suggested minion ID
+	Address string `msgpack:"ad,omitempty"` // Suggested minion address (ip:port)
+}
+
+// ErrorData is the data of an error message
+type ErrorData struct {
+	Code    string `msgpack:"c"`             // Error code
+	Message string `msgpack:"m,omitempty"`   // Error description
+	Ref     string `msgpack:"ref,omitempty"` // Reference of the rejected message
+}
+
+// HistoryQuery is the data of a history page request. Room history is requested
+// by setting the message room instead of With.
+type HistoryQuery struct {
+	With   string `msgpack:"w,omitempty"` // User the direct conversation is with
+	Before string `msgpack:"b,omitempty"` // Page cursor, empty for the newest entries
+	Limit  int    `msgpack:"l,omitempty"` // Page size
+}
+
+// NewReceipt creates a receipt message for a message and one of its recipients,
+// addressed to the message sender's session.
+func NewReceipt(msg *Message, recipient string, status ReceiptStatus) (*Message, error) {
+	data, err := msgpack.Marshal(&ReceiptData{
+		ID:        msg.GetID(),
+		Ref:       msg.GetRef(),
+		Recipient: recipient,
+		Status:    status,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, sess := msg.GetOrigin()
+
+	return &Message{
+		Type:      Receipt,
+		Data:      data,
+		Recipient: []string{msg.GetSender()},
+		Session:   sess,
+	}, nil
+}
+
+// NewError creates an error message for a message rejected for the given reason.
+func NewError(msg *Message, reason error) *Message {
+	data, _ := msgpack.Marshal(&ErrorData{
+		Code:    ErrorCode(reason),
+		Message: reason.Error(),
+		Ref:     msg.GetRef(),
+	})
+
+	return &Message{
+		Type: Error,
+		Data: data,
+	}
+}
+
+// NewReconnect creates a reconnect message.
+func NewReconnect(data *ReconnectData) (*Message, error) {
+	b, err := msgpack.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Type: Reconnect,
+		Data: b,
+	}, nil
 }
 
 // MessageFromBytes creates a new message from raw bytes
@@ -62,7 +269,10 @@ func (msg *Message) GetOutbound() ([]byte, error) {
 	out := &Message{
 		Type:   msg.GetType(),
 		Data:   msg.GetData(),
+		ID:     msg.GetID(),
+		Ref:    msg.GetRef(),
 		Sender: msg.GetSender(),
+		Room:   msg.GetRoom(),
 	}
 
 	if _, ok := TimestampRequired[msg.GetType()]; ok {
@@ -112,6 +322,16 @@ func (msg *Message) SetRecipients(ids []string) {
 	msg.Recipient = ids
 }
 
+// GetRoom gets message room
+func (msg *Message) GetRoom() string {
+	return msg.Room
+}
+
+// SetRoom sets message room
+func (msg *Message) SetRoom(id string) {
+	msg.Room = id
+}
+
 // GetTimestamp gets message timestamp
 func (msg *Message) GetTimestamp() time.Time {
 	return msg.Timestamp
@@ -121,3 +341,114 @@ func (msg *Message) GetTimestamp() time.Time {
 func (msg *Message) SetTimestamp() {
 	msg.Timestamp = time.Now()
 }
+
+// GetID gets message id
+func (msg *Message) GetID() string {
+	return msg.ID
+}
+
+// SetID assigns a new unique message id
+func (msg *Message) SetID() {
+	msg.ID = uuid.NewV4().String()
+}
+
+// GetRef gets message reference
+func (msg *Message) GetRef() string {
+	return msg.Ref
+}
+
+// GetAck gets whether delivery receipts are requested
+func (msg *Message) GetAck() bool {
+	return msg.Ack
+}
+
+// GetOrigin gets the minion id and session id of the message sender
+func (msg *Message) GetOrigin() (string, string) {
+	return msg.Origin, msg.OriginSession
+}
+
+// SetOrigin sets the minion id and session id of the message sender
+func (msg *Message) SetOrigin(id string, sess string) {
+	msg.Origin = id
+	msg.OriginSession = sess
+}
+
+// GetSession gets message target session
+func (msg *Message) GetSession() string {
+	return msg.Session
+}
+
+// SetSession sets message target session
+func (msg *Message) SetSession(sess string) {
+	msg.Session = sess
+}
+
+// GetSeq gets message session sequence number
+func (msg *Message) GetSeq() uint64 {
+	return msg.Seq
+}
+
+// SetSeq sets message session sequence number
+func (msg *Message) SetSeq(seq uint64) {
+	msg.Seq = seq
+}
+
+// seqField is the encoded key of the message session sequence number
+const seqField = "q"
+
+// ErrNotMap is returned when stamping encoded bytes that are not a message.
+var ErrNotMap = errors.New("encoded message is not a map")
+
+// StampSeq adds a session sequence number to an encoded outbound message without
+// decoding it, by appending the sequence number field to its msgpack map. The
+// message must not already have a sequence number.
+func StampSeq(data []byte, seq uint64) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrNotMap
+	}
+
+	var count, header int
+
+	switch b := data[0]; {
+	case b >= 0x80 && b <= 0x8f:
+		count, header = int(b&0x0f), 1
+	case b == 0xde && len(data) >= 3:
+		count, header = int(binary.BigEndian.Uint16(data[1:3])), 3
+	case b == 0xdf && len(data) >= 5:
+		count, header = int(binary.BigEndian.Uint32(data[1:5])), 5
+	default:
+		return nil, ErrNotMap
+	}
+
+	key, err := msgpack.Marshal(seqField)
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := msgpack.Marshal(seq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	count++
+	out := make([]byte, 0, len(data)+len(key)+len(value)+4)
+
+	switch {
+	case count <= 0x0f:
+		out = append(out, 0x80|byte(count))
+	case count <= math.MaxUint16:
+		out = append(out, 0xde, 0, 0)
+		binary.BigEndian.PutUint16(out[1:], uint16(count))
+	default:
+		out = append(out, 0xdf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(out[1:], uint32(count))
+	}
+
+	out = append(out, data[header:]...)
+	out = append(out, key...)
+	out = append(out, value...)
+
+	return out, nil
+}
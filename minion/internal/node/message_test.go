@@ -0,0 +1,161 @@
+package node
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// encodedMap encodes a msgpack map with a number of fields.
+func encodedMap(t *testing.T, fields int) []byte {
+	m := make(map[string]int, fields)
+
+	for i := 0; i < fields; i++ {
+		m["f"+strconv.Itoa(i)] = i
+	}
+
+	data, err := msgpack.Marshal(m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestStampSeq(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields int
+		seq    uint64
+		header byte
+	}{
+		{name: "empty map", fields: 0, seq: 1, header: 0x81},
+		{name: "fixmap", fields: 3, seq: 42, header: 0x84},
+		{name: "fixmap grows to map16", fields: 15, seq: 7, header: 0xde},
+		{name: "map16", fields: 100, seq: 1 << 40, header: 0xde},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := StampSeq(encodedMap(t, tt.fields), tt.seq)
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if out[0] != tt.header {
+				t.Errorf("header = %#x, want %#x", out[0], tt.header)
+			}
+
+			var decoded map[string]interface{}
+
+			if err := msgpack.Unmarshal(out, &decoded); err != nil {
+				t.Fatalf("stamped message does not decode: %v", err)
+			}
+
+			if len(decoded) != tt.fields+1 {
+				t.Errorf("decoded %d fields, want %d", len(decoded), tt.fields+1)
+			}
+
+			var seq uint64
+
+			if err := msgpack.Unmarshal(mustMarshal(t, decoded[seqField]), &seq); err != nil {
+				t.Fatal(err)
+			}
+
+			if seq != tt.seq {
+				t.Errorf("seq = %d, want %d", seq, tt.seq)
+			}
+		})
+	}
+}
+
+func TestStampSeqMessage(t *testing.T) {
+	msg := &Message{Type: Chat, ID: "id", Data: []byte("hello"), Sender: "alice"}
+	out, err := msg.GetOutbound()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamped, err := StampSeq(out, 9)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := MessageFromBytes(stamped)
+
+	if err != nil {
+		t.Fatalf("stamped message does not decode: %v", err)
+	}
+
+	if decoded.GetSeq() != 9 || decoded.GetSender() != "alice" || string(decoded.GetData()) != "hello" {
+		t.Errorf("decoded message = %+v", decoded)
+	}
+}
+
+func TestStampSeqNotMap(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "array", data: mustMarshal(t, []int{1, 2})},
+		{name: "string", data: mustMarshal(t, "text")},
+		{name: "truncated map16", data: []byte{0xde, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := StampSeq(tt.data, 1); err != ErrNotMap {
+				t.Errorf("error = %v, want %v", err, ErrNotMap)
+			}
+		})
+	}
+}
+
+// mustMarshal encodes a value with msgpack.
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := msgpack.Marshal(v)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestMessageRoom(t *testing.T) {
+	tests := []struct {
+		name string
+		room string
+	}{
+		{name: "room message", room: "lobby"},
+		{name: "direct message", room: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &Message{Type: Chat, Data: []byte("hello"), Sender: "alice"}
+			msg.SetRoom(tt.room)
+			out, err := msg.GetOutbound()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := MessageFromBytes(out)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded.GetRoom() != tt.room {
+				t.Errorf("room = %q, want %q", decoded.GetRoom(), tt.room)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package node
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/makeshiftsoftware/vsnet/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	metricsSubsystem = "minion"  // Subsystem of minion metrics
+	unknownType      = "unknown" // Label of message types without a name, keeps label cardinality bounded
+)
+
+// unknownMessage is the message type of stored messages whose type cannot be read
+const unknownMessage = MessageType(math.MaxUint8)
+
+// typeLabels are the metric labels of message types
+var typeLabels = map[MessageType]string{
+	Chat:        "chat",
+	Join:        "join",
+	Leave:       "leave",
+	Kick:        "kick",
+	Receipt:     "receipt",
+	History:     "history",
+	Welcome:     "welcome",
+	Subscribe:   "subscribe",
+	Unsubscribe: "unsubscribe",
+	Presence:    "presence",
+	Status:      "status",
+	Error:       "error",
+	Reconnect:   "reconnect",
+}
+
+var (
+	clientsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "clients_connected",
+		Help:      "Number of client sessions connected to the minion.",
+	})
+
+	clientConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "client_connects_total",
+		Help:      "Total number of client sessions registered on the minion.",
+	})
+
+	clientDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "client_disconnects_total",
+		Help:      "Total number of client sessions removed from the minion.",
+	})
+
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "messages_received_total",
+		Help:      "Total number of messages received from clients, by message type.",
+	}, []string{"type"})
+
+	messagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "messages_sent_total",
+		Help:      "Total number of messages written to clients, by message type.",
+	}, []string{"type"})
+
+	bytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "received_bytes_total",
+		Help:      "Total number of message bytes received from clients.",
+	})
+
+	bytesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "sent_bytes_total",
+		Help:      "Total number of message bytes written to clients.",
+	})
+
+	locateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "locate_duration_seconds",
+		Help:      "Time taken to locate the minions of message recipients, by target kind.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"target"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		clientsConnected,
+		clientConnects,
+		clientDisconnects,
+		messagesReceived,
+		messagesSent,
+		bytesReceived,
+		bytesSent,
+		locateDuration,
+	)
+}
+
+// typeLabel gets the metric label of a message type.
+func typeLabel(t MessageType) string {
+	if label, ok := typeLabels[t]; ok {
+		return label
+	}
+
+	return unknownType
+}
+
+// storedType reads the type of a message stored for later delivery, for metrics only.
+// Messages delivered live have their type passed along instead.
+func storedType(data []byte) MessageType {
+	var head struct {
+		Type MessageType `msgpack:"t,omitempty"`
+	}
+
+	if err := msgpack.Unmarshal(data, &head); err != nil {
+		return unknownMessage
+	}
+
+	return head.Type
+}
+
+// observeReceived records a message received from a client.
+func observeReceived(t MessageType, size int) {
+	messagesReceived.WithLabelValues(typeLabel(t)).Inc()
+	bytesReceived.Add(float64(size))
+}
+
+// observeSent records a frame written to a client.
+func observeSent(f *frame) {
+	messagesSent.WithLabelValues(typeLabel(f.typ)).Inc()
+	bytesSent.Add(float64(len(f.data)))
+}
+
+// observeLocate records the duration of a lookup of recipient locations started at a given time.
+func observeLocate(target string, start time.Time) {
+	locateDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+}
+
+// transportQueues are the transport queues of a node, by key prefix and metric label
+var transportQueues = []struct {
+	prefix string
+	label  string
+}{
+	{prefix: peerPrefix, label: "peer"},
+	{prefix: masterPrefix, label: "master"},
+}
+
+// queueCollector collects the depth of the node's transport queues
+type queueCollector struct {
+	id    string           // Node ID
+	pool  *redis.Pool      // Redis connection pool
+	depth *prometheus.Desc // Transport queue depth
+}
+
+// Describe sends the descriptor of transport queue depth.
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.depth
+}
+
+// Collect sends the current depth of the peer and master queues of the node.
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	for _, q := range transportQueues {
+		if err := conn.Send("LLEN", q.prefix+c.id); err != nil {
+			return
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return
+	}
+
+	for _, q := range transportQueues {
+		depth, err := redis.Int64(conn.Receive())
+
+		if err != nil {
+			return
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.depth, prometheus.GaugeValue, float64(depth), q.label)
+	}
+}
+
+// registerMetrics registers the metrics bound to the node.
+func (n *node) registerMetrics() {
+	h := n.hub
+
+	prometheus.MustRegister(
+		metrics.NewPoolCollector(metricsSubsystem, n.redis.Pool),
+		&queueCollector{
+			id:   n.id,
+			pool: n.redis.Pool,
+			depth: prometheus.NewDesc(
+				prometheus.BuildFQName(metrics.Namespace, metricsSubsystem, "transport_queue_depth"),
+				"Number of messages waiting in the transport queues of the minion.",
+				[]string{"queue"}, nil,
+			),
+		},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "connections",
+			Help:      "Number of connections held by the minion, including pending upgrades.",
+		}, func() float64 { return float64(h.countConnections()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "slow_consumer_evictions_total",
+			Help:      "Total number of client sessions evicted as slow consumers.",
+		}, func() float64 { return float64(atomic.LoadUint64(&h.evictions)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "slow_consumer_dropped_total",
+			Help:      "Total number of messages dropped for slow consumers.",
+		}, func() float64 { return float64(atomic.LoadUint64(&h.dropped)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: metricsSubsystem,
+			Name:      "rate_limited_total",
+			Help:      "Total number of client messages rejected by rate limits.",
+		}, func() float64 { return float64(atomic.LoadUint64(&h.limited)) }),
+	)
+}
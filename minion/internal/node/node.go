@@ -3,14 +3,20 @@ package node
 import (
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
 	"github.com/makeshiftsoftware/vsnet/pkg/grace"
+	"github.com/makeshiftsoftware/vsnet/pkg/history"
+	"github.com/makeshiftsoftware/vsnet/pkg/metrics"
 	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
 	"github.com/makeshiftsoftware/vsnet/pkg/task"
 	uuid "github.com/satori/go.uuid"
@@ -22,23 +28,47 @@ const (
 	nodeKeyExpires     = 10              // Time (in seconds) to expire node key
 	nodeIPKey          = "ip"            // Key used to store Node IP
 	nodePortKey        = "port"          // Key used to store Node port
+	nodeAdminPortKey   = "admin_port"    // Key used to store Node admin port
 	nodeConnectionsKey = "connections"   // Key used to store Node connections count
+	nodeCapacityKey    = "capacity"      // Key used to store Node connection limit
+	nodeRegionKey      = "region"        // Key used to store Node region tag
+	nodeDrainWindowKey = "drain_window"  // Key used to store Node drain window (milliseconds)
 )
 
 // ErrMinionNotFound is returned when the minion is not found in redis.
 var ErrMinionNotFound = errors.New("could not find the requested minion")
 
+// ErrMaxConnections is returned when the minion is at its connection limit.
+var ErrMaxConnections = errors.New("minion is at its connection limit")
+
+// ErrHubUnresponsive is returned when the hub does not respond to a healthcheck in time.
+var ErrHubUnresponsive = errors.New("hub is unresponsive")
+
+// ErrWrongMinion is returned when a connection ticket was issued for another minion.
+var ErrWrongMinion = errors.New("connection ticket is for another minion")
+
+// ErrMaxSessions is returned when a user is at the session limit.
+var ErrMaxSessions = errors.New("user is at the session limit")
+
+// ErrFileHistoryCluster is returned when joining a cluster of several minions with
+// the file history backend, whose history would only be visible to its own node.
+var ErrFileHistoryCluster = errors.New("file history backend is for single node deployments only")
+
 // node implementation
 type node struct {
-	once     sync.Once
-	wg       sync.WaitGroup
-	cfg      *config.Config // Node config
-	id       string         // Node ID
-	redis    *predis.Client // Redis client
-	http     *http.Server   // HTTP server
-	hub      *hub           // Node hub
-	quitc    chan os.Signal // Quit channel
-	cleanupc chan struct{}  // Cleanup channel
+	once      sync.Once
+	drainOnce sync.Once
+	joined    int32 // Node joined the cluster, set to 1 (accessed atomically)
+	wg        sync.WaitGroup
+	cfg       *config.Config      // Node config
+	id        string              // Node ID
+	redis     *predis.Client      // Redis client
+	http      *http.Server        // HTTP server
+	admin     *http.Server        // Admin HTTP server, for operators and the master only
+	upgrader  *websocket.Upgrader // Websocket upgrader
+	hub       *hub                // Node hub
+	quitc     chan os.Signal      // Quit channel
+	cleanupc  chan struct{}       // Cleanup channel
 }
 
 // New creates a new node.
@@ -51,9 +81,11 @@ func New(cfg *config.Config) *node {
 		cleanupc: make(chan struct{}, 1),
 	}
 
-	n.hub = newHub(n.id, n.redis)
+	n.hub = newHub(n.id, n.cfg, n.redis)
+	n.upgrader = newUpgrader(cfg)
 
 	n.initServer()
+	n.registerMetrics()
 
 	return n
 }
@@ -84,10 +116,28 @@ func (n *node) Start() error {
 		return err
 	}
 
+	atomic.StoreInt32(&n.joined, 1)
+
 	// Start check-in task
 	task.New(n.checkin, checkinPeriod, &n.wg, n.cleanupc)
 
-	log.Printf("[info] node listening on port %s", n.cfg.Port)
+	// Drain when requested by the master
+	go n.awaitDrain()
+
+	// Start admin http server
+	ln, err := net.Listen("tcp", n.admin.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := n.admin.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[error] admin server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("[info] node listening on port %s (admin on port %s)", n.cfg.Port, n.cfg.AdminPort)
 
 	// Start http server
 	return n.http.ListenAndServe()
@@ -98,6 +148,11 @@ func (n *node) Cleanup() {
 	n.once.Do(func() {
 		log.Print("[info] cleaning up...")
 
+		// Drain clients while the node is still alive in the cluster
+		if atomic.LoadInt32(&n.joined) == 1 {
+			n.Drain()
+		}
+
 		// Initiate cleanup by closing cleanup channel
 		close(n.cleanupc)
 
@@ -138,7 +193,11 @@ func (n *node) join() error {
 		nodePrefix+n.id,
 		nodeIPKey, n.cfg.ExternalIP,
 		nodePortKey, n.cfg.Port,
+		nodeAdminPortKey, n.cfg.AdminPort,
 		nodeConnectionsKey, 0,
+		nodeCapacityKey, n.cfg.MaxConnections,
+		nodeRegionKey, n.cfg.Region,
+		nodeDrainWindowKey, int64(n.cfg.DrainWindow/time.Millisecond),
 	); err != nil {
 		return err
 	}
@@ -152,11 +211,41 @@ func (n *node) join() error {
 		return err
 	}
 
+	// Other minions could not see history written to local files. Checked once
+	// registered, so that of two minions joining at once neither is let in.
+	if n.cfg.HistoryBackend == history.BackendFile {
+		if err := n.checkSingleNode(); err != nil {
+			if err := n.leave(); err != nil {
+				log.Printf("[error] error leaving cluster: %v", err)
+			}
+
+			return err
+		}
+	}
+
 	log.Print("[info] joined cluster")
 
 	return nil
 }
 
+// checkSingleNode checks that the node is the only minion in the cluster.
+func (n *node) checkSingleNode() error {
+	keys, err := n.redis.GetKeys(nodePrefix + "*")
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key != nodePrefix+n.id {
+			log.Printf("[error] minion %s is registered, the %s history backend allows a single minion", strings.TrimPrefix(key, nodePrefix), history.BackendFile)
+			return ErrFileHistoryCluster
+		}
+	}
+
+	return nil
+}
+
 // leave leaves minion node cluster by deleting self from redis.
 func (n *node) leave() error {
 	log.Print("[info] leaving cluster...")
@@ -166,7 +255,8 @@ func (n *node) leave() error {
 
 // checkin keeps minion node in the cluster by extending node key expiration.
 // If the node goes down, the node key will expire and the node will be treated
-// as inactive.
+// as inactive. The connections count is reconciled on every checkin. A node that
+// finds its key gone shuts down, since the master reclaims its presence and queues.
 func (n *node) checkin() bool {
 	// Extend node key expiration in redis
 	ok, err := n.redis.Expire(nodePrefix+n.id, nodeKeyExpires)
@@ -176,9 +266,20 @@ func (n *node) checkin() bool {
 		return false
 	}
 
+	// The node was evicted by the master, or expired while it could not check in
 	if !ok {
-		log.Printf("[warn] node key does not exist")
-		return false
+		n.fence()
+		return true
+	}
+
+	// Keep presence of connected clients alive with the node
+	if err := n.hub.refreshPresence(); err != nil {
+		log.Printf("[error] error refreshing presence: %v", err)
+	}
+
+	// Reconcile connections count
+	if err := n.hub.updateNode("HSET", nodeConnectionsKey, n.hub.countConnections()); err != nil {
+		log.Printf("[error] error reconciling connections count: %v", err)
 	}
 
 	return false
@@ -195,4 +296,17 @@ func (n *node) initServer() {
 		Handler: r,
 		Addr:    ":" + n.cfg.Port,
 	}
+
+	// Operator routes are served on a separate listener that clients cannot reach
+	a := mux.NewRouter()
+
+	a.HandleFunc("/healthz", n.wrapMiddleware(healthcheckHandler)).Methods("GET")
+	a.HandleFunc("/drain", n.wrapMiddleware(drainHandler)).Methods("POST")
+	a.HandleFunc("/clients", n.wrapMiddleware(getClientsHandler)).Methods("GET")
+	a.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	n.admin = &http.Server{
+		Handler: a,
+		Addr:    ":" + n.cfg.AdminPort,
+	}
 }
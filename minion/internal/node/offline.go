@@ -0,0 +1,140 @@
+package node
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+)
+
+const (
+	offlinePrefix = "offline:" // Prefix for offline message store in redis
+)
+
+// ErrOfflineDisabled is returned when storing a message while the offline store is disabled.
+var ErrOfflineDisabled = errors.New("offline store is disabled")
+
+// offline implementation. Outbound messages for clients that are not connected
+// are stored in redis as a list per client, oldest first. Each list is capped
+// to the quota, dropping the oldest messages, and expires after the TTL since
+// the last message was stored.
+type offline struct {
+	redis *predis.Client // Redis client
+	quota int            // Max messages stored per client
+	ttl   time.Duration  // Time to keep stored messages
+}
+
+// newOffline creates a new offline message store.
+func newOffline(redis *predis.Client, quota int, ttl time.Duration) *offline {
+	return &offline{
+		redis: redis,
+		quota: quota,
+		ttl:   ttl,
+	}
+}
+
+// enabled checks if the offline store is enabled.
+func (o *offline) enabled() bool {
+	return o.quota > 0
+}
+
+// store stores outbound messages for a client by its client id.
+func (o *offline) store(id string, data ...[]byte) error {
+	if !o.enabled() || len(data) == 0 {
+		return nil
+	}
+
+	conn := o.redis.Pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(data)+1)
+	args = append(args, offlinePrefix+id)
+
+	for _, d := range data {
+		args = append(args, d)
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	if err := conn.Send("RPUSH", args...); err != nil {
+		return err
+	}
+
+	// Keep only the newest messages within quota
+	if err := conn.Send("LTRIM", offlinePrefix+id, -o.quota, -1); err != nil {
+		return err
+	}
+
+	if o.ttl > 0 {
+		if err := conn.Send("PEXPIRE", offlinePrefix+id, int64(o.ttl/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// storeAll stores an outbound message for many clients by their client ids at
+// once. Either every client gets the message or, on error, none does.
+func (o *offline) storeAll(ids []string, data []byte) error {
+	if !o.enabled() || len(ids) == 0 {
+		return nil
+	}
+
+	conn := o.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := conn.Send("RPUSH", offlinePrefix+id, data); err != nil {
+			return err
+		}
+
+		if err := conn.Send("LTRIM", offlinePrefix+id, -o.quota, -1); err != nil {
+			return err
+		}
+
+		if o.ttl > 0 {
+			if err := conn.Send("PEXPIRE", offlinePrefix+id, int64(o.ttl/time.Millisecond)); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// peek gets the messages stored for a client by its client id, oldest first,
+// without removing them.
+func (o *offline) peek(id string) ([][]byte, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+
+	conn := o.redis.Pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(conn.Do("LRANGE", offlinePrefix+id, 0, -1))
+}
+
+// remove removes the given number of oldest messages stored for a client by its
+// client id, once they were handed over for delivery.
+func (o *offline) remove(id string, count int) error {
+	if !o.enabled() || count <= 0 {
+		return nil
+	}
+
+	conn := o.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("LTRIM", offlinePrefix+id, count, -1)
+	return err
+}
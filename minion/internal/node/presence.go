@@ -1,15 +1,34 @@
 package node
 
 import (
+	"time"
+
 	"github.com/garyburd/redigo/redis"
 	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
 )
 
 const (
-	clientPrefix = "client:"
+	clientPrefix  = "client:"   // Prefix for client presence in redis
+	sessionPrefix = "sessions:" // Prefix for client session connect order in redis
 )
 
-// presence implementation
+// removeScript removes a client session from presence only if it is hosted
+// by the given minion node, so that a session resumed elsewhere is kept.
+// Returns the number of remaining sessions of the client.
+var removeScript = redis.NewScript(3, `
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	redis.call("DEL", KEYS[3])
+end
+return redis.call("HLEN", KEYS[1])
+`)
+
+// presence implementation. Each client is stored in redis as a hash where each
+// field is a session id and each value is the id of the minion node hosting
+// that session. Sessions are also kept in a sorted set scored by connect time,
+// and the metadata of each session is kept in its own hash. Keys expire unless
+// refreshed on checkin.
 type presence struct {
 	id    string         // Node ID
 	redis *predis.Client // Redis client
@@ -23,41 +42,189 @@ func newPresence(id string, redis *predis.Client) *presence {
 	}
 }
 
-// add adds a client to presence by its client id.
-func (p *presence) add(id string) error {
-	_, err := p.redis.Set(clientPrefix+id, p.id)
+// add adds a client session to presence. Returns the number of sessions of
+// the client, including the added session.
+func (p *presence) add(c *client) (int, error) {
+	conn := p.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("HSET", clientPrefix+c.id, c.sess, p.id); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("ZADD", sessionPrefix+c.id, c.info.ConnectedAt, c.sess); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("HMSET", redis.Args{}.Add(sessionInfoPrefix+c.sess).AddFlat(c.info)...); err != nil {
+		return 0, err
+	}
+
+	// Presence expires with this node unless refreshed
+	if err := conn.Send("EXPIRE", clientPrefix+c.id, nodeKeyExpires); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("EXPIRE", sessionPrefix+c.id, nodeKeyExpires); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("EXPIRE", sessionInfoPrefix+c.sess, nodeKeyExpires); err != nil {
+		return 0, err
+	}
+
+	if err := conn.Send("HLEN", clientPrefix+c.id); err != nil {
+		return 0, err
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return redis.Int(result[6], nil)
+}
+
+// refresh extends the presence expiration of clients given an array of client ids,
+// and of their sessions given an array of session ids.
+func (p *presence) refresh(ids []string, sessions []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := p.redis.Pool.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		if err := conn.Send("EXPIRE", clientPrefix+id, nodeKeyExpires); err != nil {
+			return err
+		}
+
+		if err := conn.Send("EXPIRE", sessionPrefix+id, nodeKeyExpires); err != nil {
+			return err
+		}
+	}
+
+	for _, sess := range sessions {
+		if err := conn.Send("EXPIRE", sessionInfoPrefix+sess, nodeKeyExpires); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("")
 	return err
 }
 
-// remove removes a client from presence by its client id.
-func (p *presence) remove(id string) error {
-	return p.redis.Delete(clientPrefix + id)
+// remove removes a client session from presence. Returns the number of
+// remaining sessions of the client.
+func (p *presence) remove(c *client) (int, error) {
+	counts, err := p.removeMulti([]*client{c})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return counts[0], nil
 }
 
-// removeMulti removes multiple clients from presence given an array of client ids.
-func (p *presence) removeMulti(ids []string) error {
+// removeMulti removes multiple client sessions hosted by this node from presence.
+// Returns the number of remaining sessions of each client.
+func (p *presence) removeMulti(clients []*client) ([]int, error) {
 	con := p.redis.Pool.Get()
 	defer con.Close()
 
 	if err := con.Send("MULTI"); err != nil {
-		return err
+		return nil, err
+	}
+
+	for _, c := range clients {
+		if err := removeScript.Send(con, clientPrefix+c.id, sessionPrefix+c.id, sessionInfoPrefix+c.sess, c.sess, p.id); err != nil {
+			return nil, err
+		}
+	}
+
+	return redis.Ints(con.Do("EXEC"))
+}
+
+// count counts the sessions of clients given an array of client ids.
+func (p *presence) count(ids []string) ([]int, error) {
+	conn := p.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
 	}
 
 	for _, id := range ids {
-		if err := con.Send("DEL", clientPrefix+id); err != nil {
-			return err
+		if err := conn.Send("HLEN", clientPrefix+id); err != nil {
+			return nil, err
 		}
 	}
 
-	_, err := con.Do("EXEC")
-	return err
+	return redis.Ints(conn.Do("EXEC"))
+}
+
+// sessions finds the sessions of a client by its client id, ordered from
+// oldest to newest. The result will be a list of session ids and a map where
+// each key is a session id and each value is a minion id.
+func (p *presence) sessions(id string) ([]string, map[string]string, error) {
+	conn := p.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, nil, err
+	}
+
+	if err := conn.Send("ZRANGE", sessionPrefix+id, 0, -1); err != nil {
+		return nil, nil, err
+	}
+
+	if err := conn.Send("HGETALL", clientPrefix+id); err != nil {
+		return nil, nil, err
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := redis.Strings(result[0], nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locations, err := redis.StringMap(result[1], nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessions := make([]string, 0, len(order))
+
+	for _, sess := range order {
+		if _, ok := locations[sess]; ok {
+			sessions = append(sessions, sess)
+		}
+	}
+
+	return sessions, locations, nil
 }
 
 // locate finds node locations of clients given an array of client ids.
 // The result will be a map where each key is a minion id and each value
-// is an array of client ids from the original client id array that exist
-// on that minion node.
+// is an array of client ids from the original client id array that have
+// at least one session on that minion node. Clients without any session
+// are not included.
 func (p *presence) locate(ids []string) (map[string][]string, error) {
+	defer observeLocate("users", time.Now())
+
 	conn := p.redis.Pool.Get()
 	defer conn.Close()
 
@@ -68,19 +235,34 @@ func (p *presence) locate(ids []string) (map[string][]string, error) {
 	}
 
 	for _, id := range ids {
-		if err := conn.Send("GET", clientPrefix+id); err != nil {
+		if err := conn.Send("HVALS", clientPrefix+id); err != nil {
 			return locations, err
 		}
 	}
 
-	result, err := redis.Strings(conn.Do("EXEC"))
+	result, err := redis.Values(conn.Do("EXEC"))
 
 	if err != nil {
 		return locations, err
 	}
 
-	for i, location := range result {
-		locations[location] = append(locations[location], ids[i])
+	for i, val := range result {
+		minions, err := redis.Strings(val, nil)
+
+		if err != nil {
+			return locations, err
+		}
+
+		seen := make(map[string]struct{}, len(minions))
+
+		for _, location := range minions {
+			if _, ok := seen[location]; ok {
+				continue
+			}
+
+			seen[location] = struct{}{}
+			locations[location] = append(locations[location], ids[i])
+		}
 	}
 
 	return locations, nil
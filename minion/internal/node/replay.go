@@ -0,0 +1,359 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	resumePrefix    = "resume:"  // Prefix for session resume tokens in redis
+	replayPrefix    = "replay:"  // Prefix for session replay buffers in redis
+	handoffPrefix   = "handoff:" // Prefix for acknowledgements of session handoffs in redis
+	resumeIDKey     = "id"       // Key used to store the client id of a resume token
+	resumeSessKey   = "sess"     // Key used to store the session id of a resume token
+	replayQueueSize = 4096       // Max sequenced messages waiting to be added to replay buffers
+	replayBatch     = 256        // Max sequenced messages added to replay buffers per round trip
+	handoffTimeout  = 2          // Time (in seconds) to wait for the previous node of a resumed session to hand it off
+)
+
+// ErrInvalidResumeToken is returned when a resume token is unknown, expired or
+// belongs to another user.
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// replay implementation. Sequenced outbound messages of resumable sessions are
+// kept in redis as a capped list per session, so that a client reconnecting to
+// any minion node can receive the messages it missed. Messages are added to the
+// buffers in batches by a background writer, off the hub loop.
+type replay struct {
+	wg    sync.WaitGroup
+	redis *predis.Client    // Redis client
+	size  int               // Max messages kept per session
+	ttl   time.Duration     // Time to keep resume tokens and replay buffers
+	pushc chan *replayEntry // Sequenced messages waiting to be added to replay buffers
+	quitc chan struct{}     // Quit channel
+}
+
+// replayEntry is a sequenced message to add to the replay buffer of a session,
+// or the acknowledgement of a session handoff if it has no frame
+type replayEntry struct {
+	sess  string // Session ID
+	token string // Resume token of the session
+	frame *frame // Sequenced frame, nil for a handoff acknowledgement
+}
+
+// newReplay creates a new replay.
+func newReplay(redis *predis.Client, size int, ttl time.Duration) *replay {
+	return &replay{
+		redis: redis,
+		size:  size,
+		ttl:   ttl,
+		pushc: make(chan *replayEntry, replayQueueSize),
+		quitc: make(chan struct{}),
+	}
+}
+
+// start starts the replay buffer writer.
+func (r *replay) start() {
+	if !r.enabled() {
+		return
+	}
+
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			select {
+			case e := <-r.pushc:
+				r.write(r.batch(e))
+			case <-r.quitc:
+				// Write messages still waiting before stopping
+				for {
+					select {
+					case e := <-r.pushc:
+						r.write(r.batch(e))
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the replay buffer writer once waiting messages are written.
+func (r *replay) stop() {
+	close(r.quitc)
+	r.wg.Wait()
+}
+
+// enabled checks if session resumption is enabled.
+func (r *replay) enabled() bool {
+	return r.size > 0
+}
+
+// issue issues a new resume token for a client session.
+func (r *replay) issue(c *client) (string, error) {
+	token := uuid.NewV4().String()
+
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return "", err
+	}
+
+	if err := conn.Send("HMSET", resumePrefix+token, resumeIDKey, c.id, resumeSessKey, c.sess); err != nil {
+		return "", err
+	}
+
+	if err := conn.Send("PEXPIRE", resumePrefix+token, r.millis()); err != nil {
+		return "", err
+	}
+
+	_, err := conn.Do("EXEC")
+	return token, err
+}
+
+// check checks a resume token of a client by its client id without redeeming it.
+// Returns the id of the session to resume.
+func (r *replay) check(id string, token string) (string, error) {
+	values, err := redis.StringMap(r.redis.Hgetall(resumePrefix + token))
+
+	if err != nil {
+		return "", err
+	}
+
+	if values[resumeIDKey] != id || values[resumeSessKey] == "" {
+		return "", ErrInvalidResumeToken
+	}
+
+	return values[resumeSessKey], nil
+}
+
+// redeem redeems a resume token of a client by its client id. Returns the id of
+// the session to resume. A token can only be redeemed once.
+func (r *replay) redeem(id string, token string) (string, error) {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return "", err
+	}
+
+	if err := conn.Send("HGETALL", resumePrefix+token); err != nil {
+		return "", err
+	}
+
+	if err := conn.Send("DEL", resumePrefix+token); err != nil {
+		return "", err
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return "", err
+	}
+
+	values, err := redis.StringMap(result[0], nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	if values[resumeIDKey] != id || values[resumeSessKey] == "" {
+		return "", ErrInvalidResumeToken
+	}
+
+	return values[resumeSessKey], nil
+}
+
+// push queues a sequenced outbound frame to be added to the replay buffer of a
+// session. The frame reaches redis with the next batch written. Blocks only while
+// the writer is behind by a full queue.
+func (r *replay) push(sess string, token string, f *frame) {
+	select {
+	case r.pushc <- &replayEntry{sess: sess, token: token, frame: f}:
+	case <-r.quitc:
+	}
+}
+
+// handOver queues the acknowledgement that a session was handed off to another
+// connection. The acknowledgement is written after the messages already queued
+// for the session, so that its replay buffer is complete once it is received.
+func (r *replay) handOver(sess string) {
+	select {
+	case r.pushc <- &replayEntry{sess: sess}:
+	case <-r.quitc:
+	}
+}
+
+// awaitHandover waits for the acknowledgement that a session was handed off.
+// Returns false on timeout.
+func (r *replay) awaitHandover(sess string) (bool, error) {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("BLPOP", handoffPrefix+sess, handoffTimeout)
+
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// clearHandover clears an earlier acknowledgement that a session was handed off.
+func (r *replay) clearHandover(sess string) error {
+	return r.redis.Delete(handoffPrefix + sess)
+}
+
+// batch collects the given entry and entries already waiting, up to the batch size.
+func (r *replay) batch(e *replayEntry) []*replayEntry {
+	entries := []*replayEntry{e}
+
+	for len(entries) < replayBatch {
+		select {
+		case next := <-r.pushc:
+			entries = append(entries, next)
+		default:
+			return entries
+		}
+	}
+
+	return entries
+}
+
+// write adds sequenced messages to the replay buffers of their sessions in a
+// single round trip, and extends the expiration of the resume tokens along with
+// the buffers, so that a session can be resumed for the TTL after its last message.
+func (r *replay) write(entries []*replayEntry) {
+	if err := r.send(entries); err != nil {
+		log.Printf("[error] error adding %d messages to replay buffers: %v", len(entries), err)
+	}
+}
+
+// send sends the commands adding sequenced messages to replay buffers in a transaction.
+func (r *replay) send(entries []*replayEntry) error {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.frame == nil {
+			if err := conn.Send("RPUSH", handoffPrefix+e.sess, 1); err != nil {
+				return err
+			}
+
+			if err := conn.Send("EXPIRE", handoffPrefix+e.sess, 2*handoffTimeout); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		data, err := e.frame.bytes()
+
+		if err != nil {
+			log.Printf("[error] error sequencing message for replay: %v", err)
+			continue
+		}
+
+		if err := conn.Send("RPUSH", replayPrefix+e.sess, data); err != nil {
+			return err
+		}
+
+		if err := conn.Send("LTRIM", replayPrefix+e.sess, -r.size, -1); err != nil {
+			return err
+		}
+
+		if err := conn.Send("PEXPIRE", replayPrefix+e.sess, r.millis()); err != nil {
+			return err
+		}
+
+		if err := conn.Send("PEXPIRE", resumePrefix+e.token, r.millis()); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// refresh extends the expiration of the resume tokens of connected sessions.
+func (r *replay) refresh(tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	for _, token := range tokens {
+		if err := conn.Send("PEXPIRE", resumePrefix+token, r.millis()); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for range tokens {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// since gets the messages in the replay buffer of a session with a sequence
+// number greater than seq, oldest first. Also returns the highest sequence
+// number in the buffer.
+func (r *replay) since(sess string, seq uint64) ([][]byte, uint64, error) {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", replayPrefix+sess, 0, -1))
+
+	if err != nil {
+		return nil, seq, err
+	}
+
+	var missed [][]byte
+	last := seq
+
+	for _, data := range values {
+		msg, err := MessageFromBytes(data)
+
+		if err != nil {
+			return nil, seq, err
+		}
+
+		if msg.GetSeq() > seq {
+			missed = append(missed, data)
+		}
+
+		if msg.GetSeq() > last {
+			last = msg.GetSeq()
+		}
+	}
+
+	return missed, last, nil
+}
+
+// millis gets the ttl in milliseconds.
+func (r *replay) millis() int64 {
+	return int64(r.ttl / time.Millisecond)
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+)
+
+const (
+	roomPrefix = "room:" // Prefix for room membership in redis
+)
+
+// rooms implementation. Room membership is stored in redis as a hash per room,
+// where each field is a minion id and each value is the count of members on
+// that minion node. Members on this node are tracked locally.
+type rooms struct {
+	id      string                          // Node ID
+	redis   *predis.Client                  // Redis client
+	members map[string]map[*client]struct{} // Local room members
+}
+
+// newRooms creates a new rooms.
+func newRooms(id string, redis *predis.Client) *rooms {
+	return &rooms{
+		id:      id,
+		redis:   redis,
+		members: make(map[string]map[*client]struct{}),
+	}
+}
+
+// join adds a client to a room by its room id.
+func (r *rooms) join(room string, c *client) error {
+	members, ok := r.members[room]
+
+	if !ok {
+		members = make(map[*client]struct{})
+		r.members[room] = members
+	}
+
+	if _, ok := members[c]; ok {
+		return nil
+	}
+
+	members[c] = struct{}{}
+	c.rooms[room] = struct{}{}
+
+	return r.redis.Hset(roomPrefix+room, r.id, len(members))
+}
+
+// leave removes a client from a room by its room id.
+func (r *rooms) leave(room string, c *client) error {
+	members, ok := r.members[room]
+
+	if !ok {
+		return nil
+	}
+
+	if _, ok := members[c]; !ok {
+		return nil
+	}
+
+	delete(members, c)
+	delete(c.rooms, room)
+
+	// Remove node from room when its last local member leaves
+	if len(members) == 0 {
+		delete(r.members, room)
+		return r.hdel(room)
+	}
+
+	return r.redis.Hset(roomPrefix+room, r.id, len(members))
+}
+
+// leaveAll removes a client from every room it has joined.
+func (r *rooms) leaveAll(c *client) error {
+	var err error
+
+	for room := range c.rooms {
+		if e := r.leave(room, c); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// isMember checks if a client is a member of a room.
+func (r *rooms) isMember(room string, c *client) bool {
+	_, ok := r.members[room][c]
+	return ok
+}
+
+// local gets the local members of a room.
+func (r *rooms) local(room string) map[*client]struct{} {
+	return r.members[room]
+}
+
+// locate finds the ids of minion nodes hosting members of a room.
+func (r *rooms) locate(room string) ([]string, error) {
+	defer observeLocate("room", time.Now())
+
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("HKEYS", roomPrefix+room))
+}
+
+// clear removes this node from every room it hosts.
+func (r *rooms) clear() error {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for room := range r.members {
+		if err := conn.Send("HDEL", roomPrefix+room, r.id); err != nil {
+			return err
+		}
+	}
+
+	r.members = make(map[string]map[*client]struct{})
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// hdel removes this node from a room.
+func (r *rooms) hdel(room string) error {
+	conn := r.redis.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", roomPrefix+room, r.id)
+	return err
+}
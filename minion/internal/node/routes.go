@@ -1,8 +1,19 @@
 package node
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/pkg/auth"
+)
+
+const (
+	retryAfter    = 5               // Time (in seconds) clients should wait before retrying a refused connection
+	healthTimeout = 2 * time.Second // Time allowed for the hub to respond to a healthcheck
 )
 
 // handler represents a custom http route handler function.
@@ -22,6 +33,7 @@ func (n *node) wrapMiddleware(h handler) http.HandlerFunc {
 }
 
 // healthcheckHandler is an http handler function that performs a node healthcheck.
+// The node is healthy if it is registered in the cluster and its hub is responsive.
 func healthcheckHandler(n *node, w http.ResponseWriter, r *http.Request) error {
 	ok, err := n.redis.Exists(nodePrefix + n.id)
 
@@ -33,16 +45,133 @@ func healthcheckHandler(n *node, w http.ResponseWriter, r *http.Request) error {
 		return ErrMinionNotFound
 	}
 
+	if !n.hub.responsive(healthTimeout) {
+		return ErrHubUnresponsive
+	}
+
+	return nil
+}
+
+// drainHandler is an http handler function that drains the node and shuts it down.
+// The drain runs in the background.
+func drainHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	n.hub.requestDrain()
+	w.WriteHeader(http.StatusAccepted)
 	return nil
 }
 
+// getClientsHandler is an http handler function that lists the metadata of local client sessions,
+// oldest first. Pages are requested with the offset and limit query parameters.
+func getClientsHandler(n *node, w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	sessions, total := n.hub.listSessions(offset, limit)
+
+	res, err := json.Marshal(&sessionPage{
+		Sessions: sessions,
+		Offset:   offset,
+		Total:    total,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(res)
+
+	return err
+}
+
 // serveWs is an http handler function that upgrades websocket connection requests.
+// Upgrades are refused with a retry hint when the node is at its connection limit.
 func serveWs(n *node, w http.ResponseWriter, r *http.Request) error {
-	sock, err := upgrader.Upgrade(w, r, nil)
+	key, err := auth.NewAccessKey(accessToken(r), &n.cfg.Secret)
+
+	if err != nil {
+		http.Error(w, auth.ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	// Connection tickets assigned by the master are only valid on their minion
+	if key.IsTicket() && key.Minion != n.id {
+		http.Error(w, ErrWrongMinion.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	q := r.URL.Query()
+	last, _ := strconv.ParseUint(q.Get("last"), 10, 64)
+	resume, err := n.hub.resumable(key.ID, q.Get("resume"), last)
+
+	// A session that cannot be resumed falls back to a new session
+	if err != nil {
+		log.Printf("[warn] client %s could not resume session: %v", key.ID, err)
+	}
+
+	// Resuming a session does not open a new one
+	if resume == nil {
+		switch err := n.hub.admit(key.ID); err {
+		case nil:
+		case ErrMaxSessions:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return nil
+		default:
+			return err
+		}
+	}
+
+	// Draining nodes refuse new clients so they reconnect elsewhere
+	if n.hub.isDraining() {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	if !n.hub.reserve() {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, ErrMaxConnections.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+
+	sock, err := n.upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
+		n.hub.release()
+		return err
+	}
+
+	resumable, _ := strconv.ParseBool(q.Get("resumable"))
+
+	hs := &handshake{
+		resumable: resumable,
+		resume:    resume,
+		device:    q.Get("device"),
+		addr:      remoteAddr(r, n.cfg),
+		agent:     r.UserAgent(),
+		version:   q.Get("version"),
+	}
+
+	if err := n.hub.onClientConnected(key, sock, hs); err != nil {
+		n.hub.release()
+		sock.Close()
 		return err
 	}
 
-	return n.hub.onClientConnected(sock)
+	return nil
+}
+
+// accessToken gets the access token of a request from the authorization header,
+// or from the token query parameter for clients that cannot set headers.
+func accessToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+
+	return r.URL.Query().Get("token")
 }
@@ -0,0 +1,125 @@
+package node
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
+)
+
+const (
+	sessionInfoPrefix = "session:" // Prefix for session metadata in redis
+)
+
+// sessionInfo is the metadata of a client session. It is kept in redis as a
+// hash for the lifetime of the session presence.
+type sessionInfo struct {
+	Session     string `redis:"-" json:"session"`                       // Session ID
+	User        string `redis:"user" json:"user"`                       // Client ID
+	Minion      string `redis:"minion" json:"minion"`                   // Minion hosting the session
+	ConnectedAt int64  `redis:"connected_at" json:"connected_at"`       // Connect time (unix milliseconds)
+	RemoteAddr  string `redis:"remote_addr" json:"remote_addr"`         // Client IP address
+	UserAgent   string `redis:"user_agent" json:"user_agent,omitempty"` // Client user agent
+	Protocol    string `redis:"protocol" json:"protocol,omitempty"`     // Negotiated websocket subprotocol
+	Version     string `redis:"version" json:"version,omitempty"`       // Client protocol version
+	Device      string `redis:"device" json:"device,omitempty"`         // Client device type
+}
+
+// sessionPage is a page of session metadata
+type sessionPage struct {
+	Sessions []*sessionInfo `json:"sessions"` // Page sessions
+	Offset   int            `json:"offset"`   // Offset of the first session of the page
+	Total    int            `json:"total"`    // Total number of sessions
+}
+
+// newSessionInfo creates the metadata of a newly connected client session.
+func newSessionInfo(c *client, minion string, hs *handshake) *sessionInfo {
+	return &sessionInfo{
+		Session:     c.sess,
+		User:        c.id,
+		Minion:      minion,
+		ConnectedAt: time.Now().UnixNano() / int64(time.Millisecond),
+		RemoteAddr:  hs.addr,
+		UserAgent:   hs.agent,
+		Protocol:    c.sock.Subprotocol(),
+		Version:     hs.version,
+		Device:      hs.device,
+	}
+}
+
+// listSessions lists the metadata of local client sessions, oldest first,
+// skipping offset sessions and returning at most limit sessions. Also returns
+// the total number of local sessions.
+func (h *hub) listSessions(offset int, limit int) ([]*sessionInfo, int) {
+	var sessions []*sessionInfo
+
+	h.call(func() {
+		sessions = make([]*sessionInfo, 0, h.countSessions())
+
+		for _, clients := range h.clients {
+			for _, c := range clients {
+				sessions = append(sessions, c.info)
+			}
+		}
+	})
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].ConnectedAt == sessions[j].ConnectedAt {
+			return sessions[i].Session < sessions[j].Session
+		}
+
+		return sessions[i].ConnectedAt < sessions[j].ConnectedAt
+	})
+
+	total := len(sessions)
+
+	if offset > total {
+		offset = total
+	}
+
+	end := total
+
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+
+	return sessions[offset:end], total
+}
+
+// remoteAddr gets the IP address of a request. When the request comes from a
+// trusted proxy, the address is the right-most X-Forwarded-For entry that is not
+// a trusted proxy itself, since entries left of it are set by the client.
+func remoteAddr(r *http.Request, cfg *config.Config) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !cfg.Trusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+
+		// Entries that are not addresses cannot be trusted either
+		if ip == nil {
+			break
+		}
+
+		if !cfg.Trusted(ip) {
+			return hop
+		}
+
+		host = hop
+	}
+
+	return host
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/makeshiftsoftware/vsnet/minion/internal/config"
+)
+
+// trustedConfig creates a config trusting proxies in a number of networks.
+func trustedConfig(t *testing.T, cidrs ...string) *config.Config {
+	cfg := &config.Config{}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+
+	return cfg
+}
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   []string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{
+			name: "no trusted proxies",
+			peer: "203.0.113.7:5000",
+			want: "203.0.113.7",
+		},
+		{
+			name:      "forwarded header from untrusted peer",
+			peer:      "203.0.113.7:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "203.0.113.7",
+		},
+		{
+			name:      "trusted proxy",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2:5000",
+			forwarded: []string{"198.51.100.1"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "spoofed left-most entry",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2:5000",
+			forwarded: []string{"1.2.3.4, 198.51.100.1"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "chain of trusted proxies",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2:5000",
+			forwarded: []string{"198.51.100.1, 10.0.0.5", "10.0.0.3"},
+			want:      "198.51.100.1",
+		},
+		{
+			name:      "all entries trusted",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2:5000",
+			forwarded: []string{"10.0.0.5, 10.0.0.3"},
+			want:      "10.0.0.5",
+		},
+		{
+			name:    "trusted proxy without header",
+			trusted: []string{"10.0.0.0/8"},
+			peer:    "10.0.0.2:5000",
+			want:    "10.0.0.2",
+		},
+		{
+			name:      "stops at an entry that is not an address",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2:5000",
+			forwarded: []string{"198.51.100.1, unknown, 10.0.0.5"},
+			want:      "10.0.0.5",
+		},
+		{
+			name:      "ipv6",
+			trusted:   []string{"fd00::/8"},
+			peer:      "[fd00::2]:5000",
+			forwarded: []string{"2001:db8::1"},
+			want:      "2001:db8::1",
+		},
+		{
+			name:      "peer without port",
+			trusted:   []string{"10.0.0.0/8"},
+			peer:      "10.0.0.2",
+			forwarded: []string{"198.51.100.1"},
+			want:      "198.51.100.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.peer, Header: http.Header{}}
+
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := remoteAddr(r, trustedConfig(t, tt.trusted...)); got != tt.want {
+				t.Errorf("remoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
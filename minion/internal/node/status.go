@@ -0,0 +1,167 @@
+package node
+
+import (
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+)
+
+const (
+	statusPrefix      = "status:"   // Prefix for client status in redis
+	statusKey         = "status"    // Key used to store client status
+	statusTextKey     = "text"      // Key used to store client custom status text
+	statusDeviceKey   = "device"    // Key used to store client device type
+	statusLastSeenKey = "last_seen" // Key used to store client last seen time (unix milliseconds)
+	maxStatusText     = 256         // Maximum length of custom status text
+)
+
+// Statuses a client can set
+var validStatuses = map[string]struct{}{
+	(StatusOnline):    struct{}{},
+	(StatusAway):      struct{}{},
+	(StatusBusy):      struct{}{},
+	(StatusInvisible): struct{}{},
+}
+
+// statuses implementation. Rich presence of each client is stored in redis as
+// a hash of status, custom status text, device type and last seen time.
+type statuses struct {
+	redis *predis.Client // Redis client
+}
+
+// newStatuses creates a new statuses.
+func newStatuses(redis *predis.Client) *statuses {
+	return &statuses{
+		redis: redis,
+	}
+}
+
+// set updates the status of a client by its client id. Empty fields are left
+// unchanged, except for a custom status text explicitly set to empty, which
+// clears it.
+func (s *statuses) set(id string, data *StatusData) error {
+	key := statusPrefix + id
+	args := []interface{}{key, statusLastSeenKey, now()}
+
+	if data.Status != "" {
+		args = append(args, statusKey, data.Status)
+	}
+
+	if data.Text != nil && *data.Text != "" {
+		args = append(args, statusTextKey, *data.Text)
+	}
+
+	if data.Device != "" {
+		args = append(args, statusDeviceKey, data.Device)
+	}
+
+	if data.Text == nil || *data.Text != "" {
+		return s.redis.Hmset(args...)
+	}
+
+	conn := s.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HMSET", args...); err != nil {
+		return err
+	}
+
+	if err := conn.Send("HDEL", key, statusTextKey); err != nil {
+		return err
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// touch updates the last seen time of a client by its client id.
+func (s *statuses) touch(id string) error {
+	return s.redis.Hset(statusPrefix+id, statusLastSeenKey, now())
+}
+
+// events gets presence events for clients given an array of client ids and
+// whether each client is online.
+func (s *statuses) events(ids []string, online []bool) ([]PresenceEvent, error) {
+	conn := s.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if err := conn.Send("HGETALL", statusPrefix+id); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := redis.Values(conn.Do("EXEC"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]PresenceEvent, len(ids))
+
+	for i, id := range ids {
+		values, err := redis.StringMap(result[i], nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		lastSeen, _ := strconv.ParseInt(values[statusLastSeenKey], 10, 64)
+
+		events[i] = PresenceEvent{
+			User:     id,
+			Online:   online[i],
+			Status:   values[statusKey],
+			Text:     values[statusTextKey],
+			Device:   values[statusDeviceKey],
+			LastSeen: lastSeen,
+		}
+
+		if online[i] && events[i].Status == "" {
+			events[i].Status = StatusOnline
+		}
+	}
+
+	return events, nil
+}
+
+// event gets the presence event of a client.
+func (s *statuses) event(id string, online bool) (PresenceEvent, error) {
+	events, err := s.events([]string{id}, []bool{online})
+
+	if err != nil {
+		return PresenceEvent{User: id, Online: online}, err
+	}
+
+	return events[0], nil
+}
+
+// truncateText truncates a text to at most max bytes without splitting a
+// UTF-8 encoded character.
+func truncateText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+
+	return text[:max]
+}
+
+// now gets the current time in unix milliseconds.
+func now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,38 @@
+package node
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		max  int
+		want string
+	}{
+		{name: "shorter", text: "away", max: 10, want: "away"},
+		{name: "exact", text: "away", max: 4, want: "away"},
+		{name: "ascii", text: "in a meeting", max: 4, want: "in a"},
+		{name: "empty", text: "", max: 4, want: ""},
+		{name: "rune boundary", text: "héllo", max: 3, want: "hé"},
+		{name: "inside two byte rune", text: "héllo", max: 2, want: "h"},
+		{name: "inside four byte rune", text: "ok🙂", max: 4, want: "ok"},
+		{name: "leading multibyte rune", text: "🙂", max: 3, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateText(tt.text, tt.max)
+
+			if got != tt.want {
+				t.Errorf("truncateText(%q, %d) = %q, want %q", tt.text, tt.max, got, tt.want)
+			}
+
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateText(%q, %d) = %q is not valid UTF-8", tt.text, tt.max, got)
+			}
+		})
+	}
+}
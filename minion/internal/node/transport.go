@@ -102,9 +102,9 @@ func (t *transport) listen(key string, receive func(data []byte) error) error {
 		return
 	}()
 
-	go func() {
-		t.wg.Add(1)
+	t.wg.Add(1)
 
+	go func() {
 		defer func() {
 			conn.Close()
 			t.wg.Done()
@@ -0,0 +1,321 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	watchPrefix = "watch:" // Prefix for presence subscriptions in redis
+)
+
+// watchers implementation. Presence subscriptions are stored in redis as a hash
+// per watched client, where each field is a minion id and each value is the
+// count of subscribed clients on that minion node. Subscribers on this node are
+// tracked locally.
+type watchers struct {
+	id          string                          // Node ID
+	redis       *predis.Client                  // Redis client
+	subscribers map[string]map[*client]struct{} // Local subscribers by watched client id
+}
+
+// newWatchers creates a new watchers.
+func newWatchers(id string, redis *predis.Client) *watchers {
+	return &watchers{
+		id:          id,
+		redis:       redis,
+		subscribers: make(map[string]map[*client]struct{}),
+	}
+}
+
+// subscribe subscribes a client to the presence of other clients by their ids.
+func (w *watchers) subscribe(c *client, ids []string) error {
+	conn := w.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		subscribers, ok := w.subscribers[id]
+
+		if !ok {
+			subscribers = make(map[*client]struct{})
+			w.subscribers[id] = subscribers
+		}
+
+		subscribers[c] = struct{}{}
+		c.watching[id] = struct{}{}
+
+		if err := conn.Send("HSET", watchPrefix+id, w.id, len(subscribers)); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// unsubscribe unsubscribes a client from the presence of other clients by their ids.
+func (w *watchers) unsubscribe(c *client, ids []string) error {
+	conn := w.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		subscribers, ok := w.subscribers[id]
+
+		if !ok {
+			continue
+		}
+
+		delete(subscribers, c)
+		delete(c.watching, id)
+
+		// Remove node from subscriptions when its last local subscriber leaves
+		if len(subscribers) == 0 {
+			delete(w.subscribers, id)
+
+			if err := conn.Send("HDEL", watchPrefix+id, w.id); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := conn.Send("HSET", watchPrefix+id, w.id, len(subscribers)); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// unsubscribeAll unsubscribes a client from every client it watches.
+func (w *watchers) unsubscribeAll(c *client) error {
+	if len(c.watching) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(c.watching))
+
+	for id := range c.watching {
+		ids = append(ids, id)
+	}
+
+	return w.unsubscribe(c, ids)
+}
+
+// local gets the local subscribers to the presence of a client.
+func (w *watchers) local(id string) map[*client]struct{} {
+	return w.subscribers[id]
+}
+
+// locate finds the ids of minion nodes hosting subscribers to the presence of a client.
+func (w *watchers) locate(id string) ([]string, error) {
+	defer observeLocate("watchers", time.Now())
+
+	conn := w.redis.Pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("HKEYS", watchPrefix+id))
+}
+
+// clear removes this node from every presence subscription it holds.
+func (w *watchers) clear() error {
+	conn := w.redis.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for id := range w.subscribers {
+		if err := conn.Send("HDEL", watchPrefix+id, w.id); err != nil {
+			return err
+		}
+	}
+
+	w.subscribers = make(map[string]map[*client]struct{})
+
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// onSubscribe handles a presence subscription request from a client, answering
+// with a snapshot of the current presence of the requested clients.
+func (h *hub) onSubscribe(c *client, msg *Message) error {
+	ids := msg.GetRecipients()
+
+	if err := h.watchers.subscribe(c, ids); err != nil {
+		return err
+	}
+
+	counts, err := h.presence.count(ids)
+
+	if err != nil {
+		return err
+	}
+
+	online := make([]bool, len(ids))
+
+	for i, count := range counts {
+		online[i] = count > 0
+	}
+
+	events, err := h.statuses.events(ids, online)
+
+	if err != nil {
+		return err
+	}
+
+	for i, event := range events {
+		events[i] = event.Visible()
+	}
+
+	f, err := newPresenceFrame(events)
+
+	if err != nil {
+		return err
+	}
+
+	h.deliver(c, f)
+	return nil
+}
+
+// onPresence handles a presence message received from a peer node. Delivers the
+// presence events to local subscribers.
+func (h *hub) onPresence(msg *Message) error {
+	subscribers := h.watchers.local(msg.GetSender())
+
+	if len(subscribers) == 0 {
+		return nil
+	}
+
+	data, err := msg.GetOutbound()
+
+	if err != nil {
+		return err
+	}
+
+	f, err := newFrame(msg.GetType(), data)
+
+	if err != nil {
+		return err
+	}
+
+	for client := range subscribers {
+		h.deliver(client, f)
+	}
+
+	return nil
+}
+
+// notifyStatus publishes the current status of a client to its subscribers.
+func (h *hub) notifyStatus(id string, online bool) {
+	event, err := h.statuses.event(id, online)
+
+	if err != nil {
+		log.Printf("[error] error getting client status: %v", err)
+	}
+
+	h.notify(event)
+}
+
+// notify publishes a presence event of a client to every minion node hosting
+// subscribers to its presence.
+func (h *hub) notify(event PresenceEvent) {
+	event = event.Visible()
+	locations, err := h.watchers.locate(event.User)
+
+	if err != nil {
+		log.Printf("[error] error locating presence subscribers: %v", err)
+		return
+	}
+
+	if len(locations) == 0 {
+		return
+	}
+
+	data, err := msgpack.Marshal([]PresenceEvent{event})
+
+	if err != nil {
+		log.Printf("[error] error encoding presence event: %v", err)
+		return
+	}
+
+	msg := &Message{
+		Type:   Presence,
+		Data:   data,
+		Sender: event.User,
+	}
+
+	out, err := msg.GetBytes()
+
+	if err != nil {
+		log.Printf("[error] error encoding presence event: %v", err)
+		return
+	}
+
+	for _, location := range locations {
+		if err := h.transport.send(location, out); err != nil {
+			log.Printf("[error] error sending presence event: %v", err)
+		}
+	}
+}
+
+// newPresenceFrame creates an outbound frame for a list of presence events.
+func newPresenceFrame(events []PresenceEvent) (*frame, error) {
+	data, err := msgpack.Marshal(events)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Type: Presence,
+		Data: data,
+	}
+
+	out, err := msg.GetOutbound()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newFrame(Presence, out)
+}
+
+// onStatus handles a status update from a client.
+func (h *hub) onStatus(c *client, msg *Message) error {
+	var data StatusData
+
+	if err := msgpack.Unmarshal(msg.GetData(), &data); err != nil {
+		return err
+	}
+
+	if _, ok := validStatuses[data.Status]; data.Status != "" && !ok {
+		log.Printf("[warn] client %s sent invalid status %q", c.id, data.Status)
+		return nil
+	}
+
+	if data.Text != nil {
+		text := truncateText(*data.Text, maxStatusText)
+		data.Text = &text
+	}
+
+	if err := h.statuses.set(c.id, &data); err != nil {
+		return err
+	}
+
+	h.notifyStatus(c.id, true)
+	return nil
+}
@@ -2,25 +2,36 @@ package auth
 
 import (
 	"errors"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 // AccessKey access key for an authenticated user
 type AccessKey struct {
-	ID string
-	jwt.Claims
+	ID     string            `json:"id"`               // User ID
+	Role   string            `json:"role,omitempty"`   // User role
+	Minion string            `json:"minion,omitempty"` // Minion the key is restricted to (connection tickets only)
+	Attrs  map[string]string `json:"attrs,omitempty"`  // Custom user attributes
+	jwt.StandardClaims
 }
 
 // ErrInvalidToken invalid auth token
 var ErrInvalidToken = errors.New("Invalid auth token")
 
+// ErrTicketNotAllowed connection ticket used where an access token is required
+var ErrTicketNotAllowed = errors.New("Connection tickets are not accepted here")
+
 // NewAccessKey validates auth token and returns a new access key
 func NewAccessKey(auth string, jwtSecret *[]byte) (*AccessKey, error) {
 	key := AccessKey{}
 
 	verifyFunc := func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+
+		return *jwtSecret, nil
 	}
 
 	token, err := jwt.ParseWithClaims(auth, &key, verifyFunc)
@@ -28,10 +39,42 @@ func NewAccessKey(auth string, jwtSecret *[]byte) (*AccessKey, error) {
 		return &key, err
 	}
 
-	if claims, ok := token.Claims.(*AccessKey); ok && token.Valid {
-		key.ID = claims.ID
-		return &key, nil
+	if claims, ok := token.Claims.(*AccessKey); ok && token.Valid && claims.ID != "" {
+		return claims, nil
 	}
 
 	return &key, ErrInvalidToken
 }
+
+// HasClaim checks if the key has a claim with the given value. Claims are the
+// user role and custom user attributes.
+func (key *AccessKey) HasClaim(name string, value string) bool {
+	if name == "role" {
+		return key.Role == value
+	}
+
+	v, ok := key.Attrs[name]
+	return ok && v == value
+}
+
+// IsTicket checks if the key is a connection ticket restricted to a minion.
+func (key *AccessKey) IsTicket() bool {
+	return key.Minion != ""
+}
+
+// NewTicket creates a signed connection ticket for an authenticated user, valid
+// only on the given minion until it expires.
+func NewTicket(key *AccessKey, minion string, ttl time.Duration, jwtSecret *[]byte) (string, error) {
+	ticket := AccessKey{
+		ID:     key.ID,
+		Role:   key.Role,
+		Minion: minion,
+		Attrs:  key.Attrs,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, ticket).SignedString(*jwtSecret)
+}
@@ -0,0 +1,317 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Version is the control protocol version. Minions reject requests of other versions.
+const Version = 1
+
+const (
+	// ReplyPrefix is the prefix for control response queues in redis
+	ReplyPrefix = "reply:"
+	// ReplyExpires is the time (in seconds) to expire unread control responses
+	ReplyExpires = 30
+)
+
+// Control protocol errors
+var (
+	ErrUnknownCommand     = errors.New("unknown control command")
+	ErrUnsupportedVersion = errors.New("unsupported control protocol version")
+)
+
+// Command type
+type Command uint8
+
+// Command enum
+const (
+	// KickUser disconnects the sessions of a user
+	KickUser Command = iota + 1
+	// DisconnectAll disconnects every client of a minion
+	DisconnectAll
+	// Drain gracefully drains a minion and shuts it down
+	Drain
+	// Deliver delivers a message to the local sessions of users
+	Deliver
+	// UpdateLimits updates the connection limits of a role
+	UpdateLimits
+	// ReportStats reports minion stats
+	ReportStats
+	// Broadcast delivers a message to every local session matching filters
+	Broadcast
+	// Recover routes messages left in the queue of a dead minion again
+	Recover
+)
+
+// commands maps command names to commands operators may run
+var commands = map[string]Command{
+	"kick":           KickUser,
+	"disconnect_all": DisconnectAll,
+	"drain":          Drain,
+	"deliver":        Deliver,
+	"update_limits":  UpdateLimits,
+	"stats":          ReportStats,
+	"broadcast":      Broadcast,
+}
+
+// internalCommands maps command names to commands only the master runs, which cannot be parsed
+var internalCommands = map[string]Command{
+	"recover": Recover,
+}
+
+// ParseCommand gets a command operators may run by its name.
+func ParseCommand(name string) (Command, error) {
+	if cmd, ok := commands[name]; ok {
+		return cmd, nil
+	}
+
+	return 0, ErrUnknownCommand
+}
+
+// String gets the name of a command.
+func (c Command) String() string {
+	for _, names := range []map[string]Command{commands, internalCommands} {
+		for name, cmd := range names {
+			if cmd == c {
+				return name
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+// Payload creates an empty request payload for a command.
+func (c Command) Payload() interface{} {
+	switch c {
+	case KickUser:
+		return &KickUserData{}
+	case DisconnectAll:
+		return &DisconnectAllData{}
+	case Drain:
+		return &DrainData{}
+	case Deliver:
+		return &DeliverData{}
+	case UpdateLimits:
+		return &UpdateLimitsData{}
+	case ReportStats:
+		return nil
+	case Broadcast:
+		return &BroadcastData{}
+	case Recover:
+		return &RecoverData{}
+	}
+
+	return nil
+}
+
+// Result creates an empty response payload for a command.
+func (c Command) Result() interface{} {
+	if c == ReportStats {
+		return &StatsData{}
+	}
+
+	return &CountData{}
+}
+
+// Request is a control request sent from the master to a minion
+type Request struct {
+	Version uint8   `msgpack:"v"`            // Protocol version
+	ID      string  `msgpack:"id"`           // Request ID, echoed in the response
+	ReplyTo string  `msgpack:"rt,omitempty"` // Queue to push the response to, empty if no response is expected
+	Command Command `msgpack:"c"`            // Command
+	Data    []byte  `msgpack:"d,omitempty"`  // Command payload
+}
+
+// Response is a control response sent from a minion to the master
+type Response struct {
+	Version uint8  `msgpack:"v"`           // Protocol version
+	ID      string `msgpack:"id"`          // Request ID
+	Minion  string `msgpack:"m"`           // Minion ID
+	Error   string `msgpack:"e,omitempty"` // Error, empty if the command succeeded
+	Data    []byte `msgpack:"d,omitempty"` // Command result
+}
+
+// KickUserData is the payload of a kick user command
+type KickUserData struct {
+	User    string `msgpack:"u" json:"user"`                         // User ID
+	Session string `msgpack:"ss,omitempty" json:"session,omitempty"` // Session ID, empty for every session of the user
+	Reason  string `msgpack:"rs,omitempty" json:"reason,omitempty"`  // Reason sent to the client with the close frame
+}
+
+// DisconnectAllData is the payload of a disconnect all command
+type DisconnectAllData struct {
+	Reason string `msgpack:"rs,omitempty" json:"reason,omitempty"` // Reason sent to the clients with the close frame
+}
+
+// DrainData is the payload of a drain command
+type DrainData struct{}
+
+// DeliverData is the payload of a deliver command. Users in Store are not
+// delivered to, the message is kept in the offline store for them instead.
+type DeliverData struct {
+	ID      string   `msgpack:"id,omitempty" json:"id,omitempty"`      // Message ID, assigned by the minion if empty
+	Users   []string `msgpack:"u" json:"users"`                        // Recipient user IDs
+	Store   []string `msgpack:"st,omitempty" json:"store,omitempty"`   // Offline recipient user IDs
+	Type    uint8    `msgpack:"t,omitempty" json:"type,omitempty"`     // Message type
+	Sender  string   `msgpack:"s,omitempty" json:"sender,omitempty"`   // Message sender
+	Data    []byte   `msgpack:"d,omitempty" json:"data,omitempty"`     // Message data
+	Session string   `msgpack:"ss,omitempty" json:"session,omitempty"` // Target session ID, empty for every session
+}
+
+// UpdateLimitsData is the payload of an update limits command
+type UpdateLimitsData struct {
+	Role   string          `msgpack:"rl,omitempty" json:"role,omitempty"` // Role, empty for the default limits
+	Limits json.RawMessage `msgpack:"l" json:"limits"`                    // Limit overrides (JSON, same format as ROLE_LIMITS)
+}
+
+// BroadcastData is the payload of a broadcast command. Sessions must match every
+// filter that is set.
+type BroadcastData struct {
+	Type   uint8    `msgpack:"t,omitempty" json:"type,omitempty"`   // Message type
+	Sender string   `msgpack:"s,omitempty" json:"sender,omitempty"` // Message sender
+	Data   []byte   `msgpack:"d,omitempty" json:"data,omitempty"`   // Message data
+	Users  []string `msgpack:"u,omitempty" json:"users,omitempty"`  // Only sessions of these users
+	Rooms  []string `msgpack:"rm,omitempty" json:"rooms,omitempty"` // Only sessions that joined one of these rooms
+	Claim  *Claim   `msgpack:"cl,omitempty" json:"claim,omitempty"` // Only sessions of users with this claim
+}
+
+// RecoverData is the payload of a recover command
+type RecoverData struct {
+	Minion   string   `msgpack:"m" json:"minion"`    // ID of the dead minion the messages were queued for
+	Messages [][]byte `msgpack:"ms" json:"messages"` // Encoded peer messages
+}
+
+// Claim is a user claim (role or custom attribute) and its value
+type Claim struct {
+	Name  string `msgpack:"n" json:"name"`  // Claim name
+	Value string `msgpack:"v" json:"value"` // Claim value
+}
+
+// CountData is the result of commands that act on clients
+type CountData struct {
+	Count  int `msgpack:"n" json:"count"`                       // Number of sessions affected
+	Stored int `msgpack:"st,omitempty" json:"stored,omitempty"` // Number of users the message was stored for
+}
+
+// StatsData is the result of a report stats command
+type StatsData struct {
+	Connections int64  `msgpack:"cn" json:"connections"`  // Connections count, including pending upgrades
+	Users       int    `msgpack:"u" json:"users"`         // Connected users
+	Sessions    int    `msgpack:"ss" json:"sessions"`     // Connected sessions
+	Evictions   uint64 `msgpack:"ev" json:"evictions"`    // Slow consumer evictions
+	Dropped     uint64 `msgpack:"dr" json:"dropped"`      // Slow consumer dropped messages
+	Limited     uint64 `msgpack:"rl" json:"rate_limited"` // Rate limited messages
+	Draining    bool   `msgpack:"dn" json:"draining"`     // Minion is draining
+}
+
+// NewRequest creates a new control request for a command. The request expects
+// a response if replies is true.
+func NewRequest(cmd Command, payload interface{}, replies bool) (*Request, error) {
+	req := &Request{
+		Version: Version,
+		ID:      uuid.NewV4().String(),
+		Command: cmd,
+	}
+
+	if replies {
+		req.ReplyTo = ReplyPrefix + req.ID
+	}
+
+	if payload != nil {
+		data, err := msgpack.Marshal(payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Data = data
+	}
+
+	return req, nil
+}
+
+// RequestFromBytes decodes a control request.
+func RequestFromBytes(data []byte) (*Request, error) {
+	var req Request
+
+	if err := msgpack.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+
+	if req.Version != Version {
+		return &req, ErrUnsupportedVersion
+	}
+
+	return &req, nil
+}
+
+// ResponseFromBytes decodes a control response.
+func ResponseFromBytes(data []byte) (*Response, error) {
+	var res Response
+	err := msgpack.Unmarshal(data, &res)
+	return &res, err
+}
+
+// NewResponse creates a response to a request with the result of its command.
+func (req *Request) NewResponse(minion string, result interface{}, err error) *Response {
+	res := &Response{
+		Version: Version,
+		ID:      req.ID,
+		Minion:  minion,
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if result != nil {
+		data, err := msgpack.Marshal(result)
+
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+
+		res.Data = data
+	}
+
+	return res
+}
+
+// GetBytes gets request bytes
+func (req *Request) GetBytes() ([]byte, error) {
+	return msgpack.Marshal(req)
+}
+
+// GetBytes gets response bytes
+func (res *Response) GetBytes() ([]byte, error) {
+	return msgpack.Marshal(res)
+}
+
+// Decode decodes the command payload of a request.
+func (req *Request) Decode(payload interface{}) error {
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	return msgpack.Unmarshal(req.Data, payload)
+}
+
+// Decode decodes the command result of a response.
+func (res *Response) Decode(result interface{}) error {
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+
+	if len(res.Data) == 0 {
+		return nil
+	}
+
+	return msgpack.Unmarshal(res.Data, result)
+}
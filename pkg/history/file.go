@@ -0,0 +1,290 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	trailerSize = 4 // Size of the record length trailer (bytes)
+)
+
+// ErrCorruptFile is returned when a history file cannot be read back.
+var ErrCorruptFile = errors.New("corrupt history file")
+
+// FileStore stores conversation history in local files, one append-only file per
+// conversation. Each record is a msgpack encoded entry followed by its length, so
+// that pages are read backwards from the end of the file. Files are compacted to
+// the newest max entries once they hold twice as many. Files are only visible to
+// the node that writes them, so the file store is for single node deployments.
+type FileStore struct {
+	sync.Mutex
+	dir        string         // Directory for history files
+	maxEntries int            // Max entries kept per conversation (zero is unlimited)
+	counts     map[string]int // Records in each conversation file, counted on first append
+}
+
+// NewFileStore creates a new file history store in a directory.
+func NewFileStore(dir string, maxEntries int) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		dir:        dir,
+		maxEntries: maxEntries,
+		counts:     make(map[string]int),
+	}, nil
+}
+
+// Append appends an entry to a conversation. Entries are expected in timestamp order.
+func (s *FileStore) Append(conversation string, entry *Entry) error {
+	data, err := msgpack.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, len(data)+trailerSize)
+	copy(record, data)
+	binary.BigEndian.PutUint32(record[len(data):], uint32(len(data)))
+
+	s.Lock()
+	defer s.Unlock()
+
+	count, ok := s.counts[conversation]
+
+	if !ok {
+		if count, err = s.count(conversation); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path(conversation), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(record); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	count++
+
+	// Compaction is amortized over as many appends as entries kept
+	if s.maxEntries > 0 && count >= 2*s.maxEntries {
+		if err := s.compact(conversation); err != nil {
+			return err
+		}
+
+		count = s.maxEntries
+	}
+
+	s.counts[conversation] = count
+	return nil
+}
+
+// Page gets a page of conversation entries older than the before cursor, newest first.
+func (s *FileStore) Page(conversation string, before Cursor, limit int) (*Page, error) {
+	limit = clampLimit(limit)
+
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.Open(s.path(conversation))
+
+	if os.IsNotExist(err) {
+		return newPage(conversation, nil, limit), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	pos, err := f.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, limit+1)
+
+	// Walk backwards from the newest entry, within the entries kept
+	for read := 0; pos > 0 && (s.maxEntries == 0 || read < s.maxEntries); read++ {
+		var data []byte
+
+		if data, pos, err = readRecord(f, pos); err != nil {
+			return nil, err
+		}
+
+		var entry Entry
+
+		if err := msgpack.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+
+		if !before.before(&entry) {
+			continue
+		}
+
+		// Once the page is full, only entries of its oldest millisecond can still belong to it
+		if len(entries) > limit && millis(entry.Timestamp) < millis(entries[len(entries)-1].Timestamp) {
+			break
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return newer(entries[i], entries[j])
+	})
+
+	if len(entries) > limit+1 {
+		entries = entries[:limit+1]
+	}
+
+	return newPage(conversation, entries, limit), nil
+}
+
+// Close closes the store.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// count counts the records of a conversation file.
+func (s *FileStore) count(conversation string) (int, error) {
+	f, err := os.Open(s.path(conversation))
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	pos, err := f.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for pos > 0 {
+		if pos, err = skipRecord(f, pos); err != nil {
+			return 0, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// compact rewrites a conversation file with its newest max entries only.
+func (s *FileStore) compact(conversation string) error {
+	path := s.path(conversation)
+	f, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return err
+	}
+
+	pos := end
+
+	for i := 0; i < s.maxEntries && pos > 0; i++ {
+		if pos, err = skipRecord(f, pos); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, io.NewSectionReader(f, pos, end-pos)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// path gets the file path of a conversation.
+func (s *FileStore) path(conversation string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(conversation)))
+}
+
+// readRecord reads the record ending at a position of a history file. Returns the
+// record data and the position the record starts at.
+func readRecord(f *os.File, end int64) ([]byte, int64, error) {
+	start, err := skipRecord(f, end)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, end-start-trailerSize)
+
+	if _, err := f.ReadAt(data, start); err != nil {
+		return nil, 0, err
+	}
+
+	return data, start, nil
+}
+
+// skipRecord gets the position the record ending at a position of a history file starts at.
+func skipRecord(f *os.File, end int64) (int64, error) {
+	if end < trailerSize {
+		return 0, ErrCorruptFile
+	}
+
+	var trailer [trailerSize]byte
+
+	if _, err := f.ReadAt(trailer[:], end-trailerSize); err != nil {
+		return 0, err
+	}
+
+	start := end - trailerSize - int64(binary.BigEndian.Uint32(trailer[:]))
+
+	if start < 0 {
+		return 0, ErrCorruptFile
+	}
+
+	return start, nil
+}
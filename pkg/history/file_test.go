@@ -0,0 +1,148 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// appendEntries appends count entries to a conversation, several per millisecond,
+// with ids out of order within each millisecond.
+func appendEntries(t *testing.T, s *FileStore, conversation string, count int) {
+	base := time.Unix(1000, 0)
+
+	for i := 0; i < count; i++ {
+		entry := &Entry{
+			ID:        fmt.Sprintf("id%03d", (i*7)%count),
+			Sender:    "alice",
+			Data:      []byte{byte(i)},
+			Timestamp: base.Add(time.Duration(i/4) * time.Millisecond),
+		}
+
+		if err := s.Append(conversation, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pageAll pages through a conversation, returning every entry in page order.
+func pageAll(t *testing.T, s Store, conversation string, limit int) []*Entry {
+	var all []*Entry
+	var cursor Cursor
+
+	for {
+		page, err := s.Page(conversation, cursor, limit)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page.Entries) > limit {
+			t.Fatalf("page has %d entries, limit is %d", len(page.Entries), limit)
+		}
+
+		all = append(all, page.Entries...)
+
+		if page.Next == "" {
+			return all
+		}
+
+		if cursor, err = ParseCursor(page.Next); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileStorePage(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		count      int
+		limit      int
+		want       int
+	}{
+		{name: "empty conversation", maxEntries: 0, count: 0, limit: 5, want: 0},
+		{name: "single page", maxEntries: 0, count: 3, limit: 5, want: 3},
+		{name: "pages split within a millisecond", maxEntries: 0, count: 23, limit: 3, want: 23},
+		{name: "page size of one", maxEntries: 0, count: 9, limit: 1, want: 9},
+		{name: "trimmed to max entries", maxEntries: 10, count: 25, limit: 4, want: 10},
+		{name: "compacted to max entries", maxEntries: 5, count: 12, limit: 2, want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFileStore(t.TempDir(), tt.maxEntries)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appendEntries(t, s, "room:r", tt.count)
+			entries := pageAll(t, s, "room:r", tt.limit)
+
+			if len(entries) != tt.want {
+				t.Fatalf("paged %d entries, want %d", len(entries), tt.want)
+			}
+
+			seen := make(map[string]bool, len(entries))
+
+			for i, entry := range entries {
+				if seen[entry.ID] {
+					t.Errorf("entry %s paged twice", entry.ID)
+				}
+
+				seen[entry.ID] = true
+
+				if i > 0 && !newer(entries[i-1], entry) {
+					t.Errorf("entry %s is not older than entry %s", entry.ID, entries[i-1].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	s, err := NewFileStore(t.TempDir(), 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendEntries(t, s, "room:r", 9)
+
+	// Nine records are kept until the file holds twice the max entries
+	if count, err := s.count("room:r"); err != nil || count != 9 {
+		t.Fatalf("count = %d (%v), want 9", count, err)
+	}
+
+	appendEntries(t, s, "room:r", 1)
+
+	if count, err := s.count("room:r"); err != nil || count != 5 {
+		t.Fatalf("count after compaction = %d (%v), want 5", count, err)
+	}
+
+	// A new store counts the records of existing files
+	reopened, err := NewFileStore(s.dir, 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reopened.Append("room:r", &Entry{ID: "new", Timestamp: time.Unix(2000, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened.counts["room:r"] != 6 {
+		t.Errorf("count after reopening = %d, want 6", reopened.counts["room:r"])
+	}
+
+	page, err := reopened.Page("room:r", Cursor{}, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Entries) != 1 || page.Entries[0].ID != "new" {
+		t.Errorf("newest entry = %+v, want new", page.Entries)
+	}
+}
@@ -0,0 +1,181 @@
+package history
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+)
+
+// Backend names
+const (
+	BackendNone  = ""      // History disabled
+	BackendRedis = "redis" // History stored in redis
+	BackendFile  = "file"  // History stored in local files, for single node deployments only
+)
+
+const (
+	directPrefix = "dm:"   // Prefix for direct conversation ids
+	roomPrefix   = "room:" // Prefix for room conversation ids
+	defaultLimit = 50      // Default page size
+	maxLimit     = 500     // Maximum page size
+)
+
+// ErrUnknownBackend is returned when the configured history backend does not exist.
+var ErrUnknownBackend = errors.New("unknown history backend")
+
+// ErrInvalidCursor is returned when parsing a malformed page cursor.
+var ErrInvalidCursor = errors.New("invalid history cursor")
+
+// Entry is a message stored in a conversation history
+type Entry struct {
+	ID        string    `msgpack:"id" json:"id"`        // Message ID
+	Sender    string    `msgpack:"s" json:"sender"`     // Message sender
+	Data      []byte    `msgpack:"d" json:"data"`       // Message data
+	Timestamp time.Time `msgpack:"ts" json:"timestamp"` // Message timestamp
+}
+
+// Page is a page of conversation history, newest entries first
+type Page struct {
+	Conversation string   `msgpack:"c" json:"conversation"`             // Conversation ID
+	Entries      []*Entry `msgpack:"e" json:"entries"`                  // Page entries
+	Next         string   `msgpack:"n,omitempty" json:"next,omitempty"` // Cursor of the next (older) page, empty if there are no more entries
+}
+
+// Cursor is a position in a conversation history. Entries are ordered by
+// timestamp (unix milliseconds), then by id, so that entries sharing the same
+// millisecond are not skipped between pages.
+type Cursor struct {
+	Timestamp int64  // Entry timestamp (unix milliseconds)
+	ID        string // Entry ID
+}
+
+// Store is a conversation history backend
+type Store interface {
+	// Append appends an entry to a conversation.
+	Append(conversation string, entry *Entry) error
+	// Page gets up to limit entries of a conversation older than the before
+	// cursor (zero for the newest entries), newest first.
+	Page(conversation string, before Cursor, limit int) (*Page, error)
+	// Close closes the store.
+	Close() error
+}
+
+// New creates a new history store for a backend. Returns nil if history is disabled.
+func New(backend string, redis *predis.Client, dir string, maxEntries int) (Store, error) {
+	switch backend {
+	case BackendNone:
+		return nil, nil
+	case BackendRedis:
+		return NewRedisStore(redis, maxEntries), nil
+	case BackendFile:
+		return NewFileStore(dir, maxEntries)
+	}
+
+	return nil, ErrUnknownBackend
+}
+
+// DirectConversation gets the conversation id of two users.
+func DirectConversation(a string, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	return directPrefix + strings.Join(ids, ":")
+}
+
+// RoomConversation gets the conversation id of a room.
+func RoomConversation(room string) string {
+	return roomPrefix + room
+}
+
+// ParseCursor parses a page cursor. An empty cursor is the zero cursor.
+func ParseCursor(value string) (Cursor, error) {
+	if value == "" {
+		return Cursor{}, nil
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 || parts[1] == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil || ts <= 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return Cursor{Timestamp: ts, ID: parts[1]}, nil
+}
+
+// String gets the encoded page cursor, empty for the zero cursor.
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatInt(c.Timestamp, 10) + ":" + c.ID
+}
+
+// IsZero checks if a cursor is the zero cursor, which is before every entry.
+func (c Cursor) IsZero() bool {
+	return c.Timestamp == 0
+}
+
+// before checks if an entry is older than the cursor.
+func (c Cursor) before(entry *Entry) bool {
+	if c.IsZero() {
+		return true
+	}
+
+	ts := millis(entry.Timestamp)
+	return ts < c.Timestamp || (ts == c.Timestamp && entry.ID < c.ID)
+}
+
+// Cursor gets the page cursor of an entry.
+func (entry *Entry) Cursor() Cursor {
+	return Cursor{Timestamp: millis(entry.Timestamp), ID: entry.ID}
+}
+
+// newer checks if an entry comes before another, newest first.
+func newer(a *Entry, b *Entry) bool {
+	ta, tb := millis(a.Timestamp), millis(b.Timestamp)
+	return ta > tb || (ta == tb && a.ID > b.ID)
+}
+
+// millis gets a time in unix milliseconds.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// clampLimit bounds a requested page size.
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return defaultLimit
+	}
+
+	if limit > maxLimit {
+		return maxLimit
+	}
+
+	return limit
+}
+
+// newPage creates a page from entries, newest first, fetched with one extra
+// entry to detect whether an older page exists.
+func newPage(conversation string, entries []*Entry, limit int) *Page {
+	page := &Page{
+		Conversation: conversation,
+		Entries:      entries,
+	}
+
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.Next = page.Entries[limit-1].Cursor().String()
+	}
+
+	return page
+}
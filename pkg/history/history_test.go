@@ -0,0 +1,106 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Cursor
+		err   error
+	}{
+		{value: "", want: Cursor{}},
+		{value: "1500:abc", want: Cursor{Timestamp: 1500, ID: "abc"}},
+		{value: "1500:a:b", want: Cursor{Timestamp: 1500, ID: "a:b"}},
+		{value: "1500", err: ErrInvalidCursor},
+		{value: "1500:", err: ErrInvalidCursor},
+		{value: "x:abc", err: ErrInvalidCursor},
+		{value: "0:abc", err: ErrInvalidCursor},
+		{value: "-5:abc", err: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseCursor(tt.value)
+
+			if err != tt.err {
+				t.Fatalf("ParseCursor(%q) error = %v, want %v", tt.value, err, tt.err)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParseCursor(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+
+			if err == nil && got.String() != tt.value {
+				t.Errorf("cursor %+v encodes as %q, want %q", got, got.String(), tt.value)
+			}
+		})
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	at := time.Unix(10, 0)
+	entries := []*Entry{
+		{ID: "c", Timestamp: at},
+		{ID: "b", Timestamp: at},
+		{ID: "a", Timestamp: at.Add(-time.Millisecond)},
+	}
+
+	tests := []struct {
+		name    string
+		entries []*Entry
+		limit   int
+		count   int
+		next    string
+	}{
+		{name: "no entries", entries: nil, limit: 2, count: 0, next: ""},
+		{name: "fewer than limit", entries: entries[:1], limit: 2, count: 1, next: ""},
+		{name: "exactly limit", entries: entries[:2], limit: 2, count: 2, next: ""},
+		{name: "more than limit", entries: entries, limit: 2, count: 2, next: "10000:b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := newPage("room:r", tt.entries, tt.limit)
+
+			if len(page.Entries) != tt.count {
+				t.Errorf("page has %d entries, want %d", len(page.Entries), tt.count)
+			}
+
+			if page.Next != tt.next {
+				t.Errorf("next = %q, want %q", page.Next, tt.next)
+			}
+		})
+	}
+}
+
+func TestCursorBefore(t *testing.T) {
+	at := time.Unix(10, 0)
+	cursor := Cursor{Timestamp: 10000, ID: "m"}
+
+	tests := []struct {
+		name  string
+		entry *Entry
+		want  bool
+	}{
+		{name: "older millisecond", entry: &Entry{ID: "z", Timestamp: at.Add(-time.Millisecond)}, want: true},
+		{name: "newer millisecond", entry: &Entry{ID: "a", Timestamp: at.Add(time.Millisecond)}, want: false},
+		{name: "same millisecond lower id", entry: &Entry{ID: "l", Timestamp: at}, want: true},
+		{name: "same millisecond higher id", entry: &Entry{ID: "n", Timestamp: at}, want: false},
+		{name: "cursor entry", entry: &Entry{ID: "m", Timestamp: at}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cursor.before(tt.entry); got != tt.want {
+				t.Errorf("before = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if !(Cursor{}).before(&Entry{ID: "a", Timestamp: at}) {
+		t.Error("zero cursor must be before every entry")
+	}
+}
@@ -0,0 +1,143 @@
+package history
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+	predis "github.com/makeshiftsoftware/vsnet/pkg/redis"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	historyPrefix     = "history:"      // Prefix for conversation history entry ids in redis
+	historyDataPrefix = "history_data:" // Prefix for conversation history entry data in redis
+)
+
+// appendScript adds an entry to a conversation, then drops the oldest entries
+// beyond the max entries (zero is unlimited).
+var appendScript = redis.NewScript(2, `
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+local max = tonumber(ARGV[4])
+if max > 0 then
+	local excess = redis.call("ZCARD", KEYS[1]) - max
+	if excess > 0 then
+		local ids = redis.call("ZRANGE", KEYS[1], 0, excess - 1)
+		redis.call("ZREMRANGEBYRANK", KEYS[1], 0, excess - 1)
+		redis.call("HDEL", KEYS[2], unpack(ids))
+	end
+end
+return 1
+`)
+
+// pageScript gets the data of up to count entries of a conversation older than
+// a cursor (timestamp and id, an empty timestamp for the newest entries), newest
+// first. Entries of the same timestamp are ordered by id, like sorted set members
+// of the same score.
+var pageScript = redis.NewScript(2, `
+local count = tonumber(ARGV[3])
+local ids = {}
+local max = "+inf"
+if ARGV[1] ~= "" then
+	local same = redis.call("ZREVRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
+	for _, id in ipairs(same) do
+		if #ids < count and id < ARGV[2] then
+			table.insert(ids, id)
+		end
+	end
+	max = "(" .. ARGV[1]
+end
+if #ids < count then
+	local older = redis.call("ZREVRANGEBYSCORE", KEYS[1], max, "-inf", "LIMIT", 0, count - #ids)
+	for _, id in ipairs(older) do
+		table.insert(ids, id)
+	end
+end
+if #ids == 0 then
+	return {}
+end
+return redis.call("HMGET", KEYS[2], unpack(ids))
+`)
+
+// RedisStore stores conversation history in redis. Entry ids are kept in a sorted
+// set per conversation, scored by entry timestamp (unix milliseconds), and entry
+// data in a hash per conversation.
+type RedisStore struct {
+	redis      *predis.Client // Redis client
+	maxEntries int            // Max entries kept per conversation (zero is unlimited)
+}
+
+// NewRedisStore creates a new redis history store.
+func NewRedisStore(redis *predis.Client, maxEntries int) *RedisStore {
+	return &RedisStore{
+		redis:      redis,
+		maxEntries: maxEntries,
+	}
+}
+
+// Append appends an entry to a conversation.
+func (s *RedisStore) Append(conversation string, entry *Entry) error {
+	data, err := msgpack.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	conn := s.redis.Pool.Get()
+	defer conn.Close()
+
+	_, err = appendScript.Do(
+		conn,
+		historyPrefix+conversation, historyDataPrefix+conversation,
+		millis(entry.Timestamp), entry.ID, data, s.maxEntries,
+	)
+
+	return err
+}
+
+// Page gets a page of conversation entries older than the before cursor, newest first.
+func (s *RedisStore) Page(conversation string, before Cursor, limit int) (*Page, error) {
+	limit = clampLimit(limit)
+	ts := ""
+
+	if !before.IsZero() {
+		ts = strconv.FormatInt(before.Timestamp, 10)
+	}
+
+	conn := s.redis.Pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(pageScript.Do(
+		conn,
+		historyPrefix+conversation, historyDataPrefix+conversation,
+		ts, before.ID, limit+1,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, len(values))
+
+	for _, v := range values {
+		// Entries without data are skipped
+		if v == nil {
+			continue
+		}
+
+		var entry Entry
+
+		if err := msgpack.Unmarshal(v, &entry); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return newPage(conversation, entries, limit), nil
+}
+
+// Close closes the store. The redis client is owned by the caller.
+func (s *RedisStore) Close() error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace is the namespace of every vsnet metric
+const Namespace = "vsnet"
+
+// Handler gets the http handler exposing registered metrics in the prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// poolCollector collects redis connection pool stats
+type poolCollector struct {
+	pool   *redis.Pool      // Redis connection pool
+	active *prometheus.Desc // Connections in the pool, in use or idle
+	idle   *prometheus.Desc // Idle connections in the pool
+}
+
+// NewPoolCollector creates a collector of redis connection pool stats.
+func NewPoolCollector(subsystem string, pool *redis.Pool) prometheus.Collector {
+	return &poolCollector{
+		pool: pool,
+		active: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, subsystem, "redis_pool_active_connections"),
+			"Number of connections in the redis pool, in use or idle.",
+			nil, nil,
+		),
+		idle: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, subsystem, "redis_pool_idle_connections"),
+			"Number of idle connections in the redis pool.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe sends the descriptors of pool stats.
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.idle
+}
+
+// Collect sends the current pool stats.
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pool.Stats()
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(stats.ActiveCount))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.IdleCount))
+}